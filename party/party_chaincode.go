@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Party types. A party of type both may be used as customer and supplier.
+const (
+	partyCustomer = "customer"
+	partySupplier = "supplier"
+	partyBoth     = "both"
+)
+
+// Only callers whose certificate carries role=manager may create, change or
+// deactivate parties.
+const (
+	roleAttribute = "role"
+	managerRole   = "manager"
+)
+
+type PartyChaincode struct {
+	contractapi.Contract
+}
+
+// party is a customer or supplier, referenced by party_id from the client
+// field of purchases and sales. A customer without credit_limit is not
+// limited by the sell chaincode. The limit is only changed by create and
+// setCreditLimit, which record who changed it, when and why, so getHistory
+// is the audit trail of the limit.
+type party struct {
+	PartyID          string  `json:"party_id"`
+	Name             string  `json:"name"`
+	TaxNo            string  `json:"tax_no" metadata:",optional"`
+	Type             string  `json:"type"`
+	CreditLimit      float64 `json:"credit_limit,omitempty" metadata:",optional"`
+	LimitChangedBy   string  `json:"limit_changed_by,omitempty" metadata:",optional"`
+	LimitChangedTime int64   `json:"limit_changed_time,omitempty" metadata:",optional"`
+	LimitReason      string  `json:"limit_reason,omitempty" metadata:",optional"`
+	Active           bool    `json:"active" metadata:",optional"`
+	// hasLimit tells a credit_limit of 0 from no credit_limit at all
+	hasLimit bool
+}
+
+// partyHistory is one change of a party, Value is left out for a delete.
+type partyHistory struct {
+	TxId      string `json:"TxId"`
+	Value     *party `json:"Value,omitempty" metadata:",optional"`
+	Timestamp string `json:"Timestamp"`
+	IsDelete  bool   `json:"IsDelete"`
+}
+
+// MarshalJSON leaves credit_limit out for a party without a limit and keeps
+// a limit of 0.
+func (p party) MarshalJSON() ([]byte, error) {
+	type alias party
+	out := struct {
+		alias
+		CreditLimit *float64 `json:"credit_limit,omitempty"`
+	}{alias: alias(p)}
+	out.CreditLimit = p.limit()
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads whether credit_limit is given at all.
+func (p *party) UnmarshalJSON(data []byte) error {
+	type alias party
+	in := struct {
+		*alias
+		CreditLimit *float64 `json:"credit_limit"`
+	}{alias: (*alias)(p)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	p.setLimit(in.CreditLimit)
+	return nil
+}
+
+// limit is the credit limit of a party, nil for none.
+func (p *party) limit() *float64 {
+	if !p.hasLimit {
+		return nil
+	}
+	limit := p.CreditLimit
+	return &limit
+}
+
+func (p *party) setLimit(limit *float64) {
+	p.CreditLimit, p.hasLimit = 0, limit != nil
+	if limit != nil {
+		p.CreditLimit = *limit
+	}
+}
+
+func (p *party) validate() error {
+	if p.PartyID == "" {
+		return fmt.Errorf("party_id must be required")
+	}
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("name must be required")
+	}
+	if p.Type != partyCustomer && p.Type != partySupplier && p.Type != partyBoth {
+		return fmt.Errorf("type must be customer, supplier or both")
+	}
+	if p.hasLimit {
+		if p.Type == partySupplier {
+			return fmt.Errorf("credit_limit is only allowed for customers")
+		}
+		if p.CreditLimit < 0 {
+			return fmt.Errorf("credit_limit must not be negative")
+		}
+	}
+	return nil
+}
+
+// normalizeName folds the spellings clerks use for the same party
+// ("client1", "Client 1", "CLIENT1") into one index entry.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), ""))
+}
+
+// ===================================================================================
+// Main
+// ===================================================================================
+func main() {
+	chaincode, err := contractapi.NewChaincode(newPartyChaincode())
+	if err != nil {
+		fmt.Printf("Error creating party chaincode: %s", err)
+		return
+	}
+	if err := chaincode.Start(); err != nil {
+		fmt.Printf("Error starting party chaincode: %s", err)
+	}
+}
+
+func newPartyChaincode() *PartyChaincode {
+	t := new(PartyChaincode)
+	t.Name = "party"
+	t.Info.Description = "Customers and suppliers referenced by purchases and sales"
+	return t
+}
+
+// GetEvaluateTransactions marks the transactions that only read the ledger,
+// so clients query rather than submit them.
+func (t *PartyChaincode) GetEvaluateTransactions() []string {
+	return []string{"Query", "Check", "GetHistory"}
+}
+
+// ============================================================
+// create - register a new party, store into chaincode state
+// ============================================================
+func (t *PartyChaincode) Create(ctx contractapi.TransactionContextInterface, p party) error {
+	stub := ctx.GetStub()
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a manager may create a party: " + err.Error())
+	}
+
+	// ==== Input sanitation ====
+	fmt.Println("- start create party")
+	if err := p.validate(); err != nil {
+		return err
+	}
+	p.Active = true
+	key := p.PartyID
+	if p.hasLimit {
+		if err := recordLimitChange(stub, &p, "initial limit"); err != nil {
+			return err
+		}
+	} else {
+		p.LimitChangedBy, p.LimitChangedTime, p.LimitReason = "", 0, ""
+	}
+
+	// ==== Check if party already exists ====
+	partyAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errors.New("Failed to get party: " + err.Error())
+	} else if partyAsBytes != nil {
+		return fmt.Errorf("The key %s has already existed!", key)
+	}
+
+	if err := indexName(stub, &p); err != nil {
+		return err
+	}
+	if err := putParty(stub, &p); err != nil {
+		return err
+	}
+
+	fmt.Println("- end create party")
+	return nil
+}
+
+// ============================================================
+// update - change name, tax number or type of a party
+// ============================================================
+func (t *PartyChaincode) Update(ctx contractapi.TransactionContextInterface, p party) error {
+	stub := ctx.GetStub()
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a manager may update a party: " + err.Error())
+	}
+
+	// ==== Input sanitation ====
+	fmt.Println("- start update party")
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	old, err := getParty(stub, p.PartyID)
+	if err != nil {
+		return err
+	}
+	p.Active = old.Active
+	// setCreditLimit is the only way to change the limit
+	if !sameLimit(old.limit(), p.limit()) {
+		return errors.New("credit_limit can only be changed with setCreditLimit")
+	}
+	p.LimitChangedBy = old.LimitChangedBy
+	p.LimitChangedTime = old.LimitChangedTime
+	p.LimitReason = old.LimitReason
+
+	if normalizeName(old.Name) != normalizeName(p.Name) {
+		oldIndexKey, err := stub.CreateCompositeKey("name~id", []string{normalizeName(old.Name), old.PartyID})
+		if err != nil {
+			return err
+		}
+		if err := stub.DelState(oldIndexKey); err != nil {
+			return err
+		}
+		if err := indexName(stub, &p); err != nil {
+			return err
+		}
+	}
+	if err := putParty(stub, &p); err != nil {
+		return err
+	}
+
+	fmt.Println("- end update party")
+	return nil
+}
+
+// ============================================================
+// setActive - activate or deactivate a party
+// ============================================================
+func (t *PartyChaincode) SetActive(ctx contractapi.TransactionContextInterface, partyID string, active bool) error {
+	stub := ctx.GetStub()
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a manager may activate or deactivate a party: " + err.Error())
+	}
+
+	// ==== Input sanitation ====
+	fmt.Println("- start setActive party")
+	if len(partyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
+	}
+
+	p, err := getParty(stub, partyID)
+	if err != nil {
+		return err
+	}
+	p.Active = active
+
+	if err := putParty(stub, p); err != nil {
+		return err
+	}
+
+	fmt.Println("- end setActive party")
+	return nil
+}
+
+// ============================================================
+// setCreditLimit - change the credit limit of a customer
+// args: party_id, credit_limit ("" for no limit), reason
+// ============================================================
+func (t *PartyChaincode) SetCreditLimit(ctx contractapi.TransactionContextInterface, partyID string, creditLimit string, reason string) error {
+	stub := ctx.GetStub()
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a manager may change a credit limit: " + err.Error())
+	}
+
+	// ==== Input sanitation ====
+	fmt.Println("- start setCreditLimit party")
+	if len(partyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
+	}
+	var limit *float64
+	if creditLimit != "" {
+		v, err := strconv.ParseFloat(creditLimit, 64)
+		if err != nil {
+			return errors.New("2nd argument must be a numeric string or empty")
+		}
+		limit = &v
+	}
+	if len(reason) <= 0 {
+		return errors.New("A reason is required to change a credit limit")
+	}
+
+	p, err := getParty(stub, partyID)
+	if err != nil {
+		return err
+	}
+	if sameLimit(p.limit(), limit) {
+		return errors.New("The credit limit of " + partyID + " is unchanged")
+	}
+	p.setLimit(limit)
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if err := recordLimitChange(stub, p, reason); err != nil {
+		return err
+	}
+
+	if err := putParty(stub, p); err != nil {
+		return err
+	}
+
+	fmt.Println("- end setCreditLimit party")
+	return nil
+}
+
+func sameLimit(a *float64, b *float64) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+// recordLimitChange stamps a party with the caller and time of a change of
+// its credit limit.
+func recordLimitChange(stub shim.ChaincodeStubInterface, p *party, reason string) error {
+	changedBy, err := callerIdentity(stub)
+	if err != nil {
+		return err
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	p.LimitChangedBy = changedBy
+	p.LimitChangedTime = txTimestamp.Seconds
+	p.LimitReason = reason
+	return nil
+}
+
+func callerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + cert.Subject.CommonName, nil
+}
+
+// ==================================================
+// query - query a party by party_id
+// ==================================================
+func (t *PartyChaincode) Query(ctx contractapi.TransactionContextInterface, partyID string) (*party, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start query party")
+
+	// ==== Input sanitation ====
+	if len(partyID) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	partyAsbytes, err := stub.GetState(partyID)
+	if err != nil {
+		jsonResp := "{\"Error\":\"Failed to get state for " + partyID + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	if partyAsbytes == nil {
+		jsonResp := "{\"Error\":\"Nil party for " + partyID + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	var p party
+	if err := json.Unmarshal(partyAsbytes, &p); err != nil {
+		return nil, errors.New("Failed to decode JSON of: " + partyID)
+	}
+
+	fmt.Println("- end query party")
+	return &p, nil
+}
+
+// ==================================================
+// check - fail unless party_id is an active party usable in a role
+// ==================================================
+func (t *PartyChaincode) Check(ctx contractapi.TransactionContextInterface, partyID string, role string) error {
+	stub := ctx.GetStub()
+	fmt.Println("- start check party")
+
+	p, err := getParty(stub, partyID)
+	if err != nil {
+		return err
+	}
+	if !p.Active {
+		return errors.New("The party " + partyID + " is not active")
+	}
+	if p.Type != partyBoth && p.Type != role {
+		return errors.New("The party " + partyID + " is not a " + role)
+	}
+
+	fmt.Println("- end check party")
+	return nil
+}
+
+// indexName rejects a party whose normalized name is already taken by
+// another party and records the name otherwise.
+func indexName(stub shim.ChaincodeStubInterface, p *party) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("name~id", []string{normalizeName(p.Name)})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			return err
+		}
+		if keyParts[1] != p.PartyID {
+			return fmt.Errorf("The name %s is already used by party %s", p.Name, keyParts[1])
+		}
+	}
+
+	indexKey, err := stub.CreateCompositeKey("name~id", []string{normalizeName(p.Name), p.PartyID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(indexKey, []byte{0x00})
+}
+
+func getParty(stub shim.ChaincodeStubInterface, partyID string) (*party, error) {
+	partyAsBytes, err := stub.GetState(partyID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get party: %s", err.Error())
+	} else if partyAsBytes == nil {
+		return nil, fmt.Errorf("Unknown party: %s", partyID)
+	}
+	var p party
+	if err := json.Unmarshal(partyAsBytes, &p); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", partyID)
+	}
+	return &p, nil
+}
+
+func putParty(stub shim.ChaincodeStubInterface, p *party) error {
+	partyJSONasBytes, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(p.PartyID, partyJSONasBytes)
+}
+
+func (t *PartyChaincode) GetHistory(ctx contractapi.TransactionContextInterface, partyID string) ([]partyHistory, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start getHistory party")
+
+	fmt.Printf("- start getHistory: %s\n", partyID)
+
+	resultsIterator, err := stub.GetHistoryForKey(partyID)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	history := []partyHistory{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		h := partyHistory{
+			TxId:      response.TxId,
+			Timestamp: time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String(),
+			IsDelete:  response.IsDelete,
+		}
+		if !response.IsDelete {
+			h.Value = &party{}
+			if err := json.Unmarshal(response.Value, h.Value); err != nil {
+				return nil, errors.New("Failed to decode JSON of: " + partyID)
+			}
+		}
+		history = append(history, h)
+	}
+
+	fmt.Println("- end getHistory party")
+	return history, nil
+}
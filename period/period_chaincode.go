@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Only callers whose certificate carries role=manager may close or reopen a
+// period.
+const (
+	roleAttribute = "role"
+	managerRole   = "manager"
+)
+
+// Period statuses. A period that was never closed is open.
+const (
+	statusOpen   = "open"
+	statusClosed = "closed"
+)
+
+type PeriodChaincode struct {
+	contractapi.Contract
+}
+
+// period is an accounting month YYYYMM (UTC) of a company. Every close and
+// reopen rewrites it, so getHistory is the audit trail of who changed it,
+// when and why.
+type period struct {
+	CompanyID   string `json:"company_id"`
+	Period      string `json:"period"`
+	Status      string `json:"status"`
+	ChangedBy   string `json:"changed_by"`
+	ChangedTime int64  `json:"changed_time"`
+	Reason      string `json:"reason"`
+}
+
+// periodHistory is one close or reopen of a period, Value is left out for a
+// delete.
+type periodHistory struct {
+	TxId      string  `json:"TxId"`
+	Value     *period `json:"Value,omitempty" metadata:",optional"`
+	Timestamp string  `json:"Timestamp"`
+	IsDelete  bool    `json:"IsDelete"`
+}
+
+// ===================================================================================
+// Main
+// ===================================================================================
+func main() {
+	chaincode, err := contractapi.NewChaincode(newPeriodChaincode())
+	if err != nil {
+		fmt.Printf("Error creating period chaincode: %s", err)
+		return
+	}
+	if err := chaincode.Start(); err != nil {
+		fmt.Printf("Error starting period chaincode: %s", err)
+	}
+}
+
+func newPeriodChaincode() *PeriodChaincode {
+	t := new(PeriodChaincode)
+	t.Name = "period"
+	t.Info.Description = "Accounting periods of the companies, closed and reopened by managers"
+	return t
+}
+
+// GetEvaluateTransactions marks the transactions that only read the ledger,
+// so clients query rather than submit them.
+func (t *PeriodChaincode) GetEvaluateTransactions() []string {
+	return []string{"Query", "Check", "GetHistory"}
+}
+
+// ============================================================
+// closePeriod - close a period, reason may be empty
+// ============================================================
+func (t *PeriodChaincode) ClosePeriod(ctx contractapi.TransactionContextInterface, companyID string, month string, reason string) (*period, error) {
+	return setStatus(ctx, companyID, month, reason, statusClosed)
+}
+
+// ============================================================
+// reopenPeriod - reopen a closed period, reason is required
+// ============================================================
+func (t *PeriodChaincode) ReopenPeriod(ctx contractapi.TransactionContextInterface, companyID string, month string, reason string) (*period, error) {
+	return setStatus(ctx, companyID, month, reason, statusOpen)
+}
+
+func periodKey(stub shim.ChaincodeStubInterface, companyID string, month string) (string, error) {
+	return stub.CreateCompositeKey("period", []string{companyID, month})
+}
+
+func getPeriod(stub shim.ChaincodeStubInterface, companyID string, month string) (*period, error) {
+	key, err := periodKey(stub, companyID, month)
+	if err != nil {
+		return nil, err
+	}
+	periodAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	p := &period{CompanyID: companyID, Period: month, Status: statusOpen}
+	if periodAsBytes == nil {
+		return p, nil
+	}
+	if err := json.Unmarshal(periodAsBytes, p); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", key)
+	}
+	return p, nil
+}
+
+func callerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + cert.Subject.CommonName, nil
+}
+
+// ============================================================
+// setStatus - close or reopen a period
+// args: company_id, YYYYMM, reason (required to reopen)
+// ============================================================
+func setStatus(ctx contractapi.TransactionContextInterface, companyID string, month string, reason string, status string) (*period, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start setStatus " + status)
+	if len(companyID) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+	if _, err := time.Parse("200601", month); err != nil || len(month) != 6 {
+		return nil, errors.New("2nd argument must be a period YYYYMM")
+	}
+	if status == statusOpen && reason == "" {
+		return nil, errors.New("A reason is required to reopen a period")
+	}
+
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return nil, errors.New("Only a manager may close or reopen a period: " + err.Error())
+	}
+	changedBy, err := callerIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := getPeriod(stub, companyID, month)
+	if err != nil {
+		return nil, err
+	}
+	if p.Status == status {
+		return nil, fmt.Errorf("The period %s of company %s is already %s", p.Period, p.CompanyID, status)
+	}
+	p.Status = status
+	p.ChangedBy = changedBy
+	p.ChangedTime = txTimestamp.Seconds
+	p.Reason = reason
+
+	key, err := periodKey(stub, p.CompanyID, p.Period)
+	if err != nil {
+		return nil, err
+	}
+	periodJSONasBytes, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := stub.PutState(key, periodJSONasBytes); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end setStatus " + status)
+	return p, nil
+}
+
+// ==================================================
+// query - periods of a company that were ever closed
+// ==================================================
+func (t *PeriodChaincode) Query(ctx contractapi.TransactionContextInterface, companyID string) ([]period, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start query period")
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("period", []string{companyID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	periods := []period{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var p period
+		if err := json.Unmarshal(response.Value, &p); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		periods = append(periods, p)
+	}
+
+	fmt.Println("- end query period")
+	return periods, nil
+}
+
+// ==================================================
+// check - fail if acc_time (unix seconds) of a company falls in a closed
+// period. Called by purchase, sell and store before they change a document.
+// ==================================================
+func (t *PeriodChaincode) Check(ctx contractapi.TransactionContextInterface, companyID string, accTime int64) error {
+	stub := ctx.GetStub()
+	fmt.Println("- start check period")
+
+	month := time.Unix(accTime, 0).UTC().Format("200601")
+	p, err := getPeriod(stub, companyID, month)
+	if err != nil {
+		return err
+	}
+	if p.Status == statusClosed {
+		return fmt.Errorf("The period %s of company %s is closed", month, companyID)
+	}
+
+	fmt.Println("- end check period")
+	return nil
+}
+
+// ===========================================================================================
+// getHistory - closes and reopens of a period of a company
+// ===========================================================================================
+func (t *PeriodChaincode) GetHistory(ctx contractapi.TransactionContextInterface, companyID string, month string) ([]periodHistory, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start getHistory period")
+
+	key, err := periodKey(stub, companyID, month)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("- start getHistory: %s-%s\n", companyID, month)
+
+	resultsIterator, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	history := []periodHistory{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		h := periodHistory{
+			TxId:      response.TxId,
+			Timestamp: time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String(),
+			IsDelete:  response.IsDelete,
+		}
+		if !response.IsDelete {
+			h.Value = &period{}
+			if err := json.Unmarshal(response.Value, h.Value); err != nil {
+				return nil, errors.New("Failed to decode JSON of: " + key)
+			}
+		}
+		history = append(history, h)
+	}
+
+	fmt.Println("- end getHistory period")
+	return history, nil
+}
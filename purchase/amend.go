@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// revision is one amendment of a purchase. Lines are listed before and
+// after the change without their money, which is kept with the prices in the
+// owner's collection and shown to its members by revisions.
+type revision struct {
+	Key             string          `json:"key"`
+	Revision        int             `json:"revision"`
+	EditedBy        string          `json:"edited_by"`
+	EditedTime      int64           `json:"edited_time"`
+	TxID            string          `json:"tx_id"`
+	Reason          string          `json:"reason"`
+	Fields          []fieldChange   `json:"fields,omitempty" metadata:",optional"`
+	Lines           []lineChange    `json:"lines,omitempty" metadata:",optional"`
+	PriceCollection string          `json:"price_collection,omitempty" metadata:",optional"`
+	PriceHash       string          `json:"price_hash,omitempty" metadata:",optional"`
+	Prices          *revisionPrices `json:"prices,omitempty" metadata:",optional"`
+}
+
+type fieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// lineChange is a line (1-based) that was changed, added (no before) or
+// removed (no after).
+type lineChange struct {
+	Line   int          `json:"line"`
+	Before *subPurchase `json:"before,omitempty" metadata:",optional"`
+	After  *subPurchase `json:"after,omitempty" metadata:",optional"`
+}
+
+type revisionPrices struct {
+	Before []pricedLine `json:"before"`
+	After  []pricedLine `json:"after"`
+}
+
+func pricedLines(p *purchase) []pricedLine {
+	lines := []pricedLine{}
+	for _, l := range p.Items {
+		lines = append(lines, pricedLine{SpecID: l.SpecID, How: l.How, Money: l.Money, BaseMoney: l.BaseMoney, Tax: l.Tax})
+	}
+	return lines
+}
+
+func diffLines(before []subPurchase, after []subPurchase) []lineChange {
+	changes := []lineChange{}
+	for i := 0; i < len(before) || i < len(after); i++ {
+		var b, a *subPurchase
+		if i < len(before) {
+			line := before[i]
+			b = &line
+		}
+		if i < len(after) {
+			line := after[i]
+			a = &line
+		}
+		if b != nil && a != nil && reflect.DeepEqual(*b, *a) {
+			continue
+		}
+		// the money stays in the private collection
+		for _, l := range []*subPurchase{b, a} {
+			if l != nil {
+				l.Money = 0
+				l.BaseMoney = 0
+				l.Tax = 0
+			}
+		}
+		changes = append(changes, lineChange{Line: i + 1, Before: b, After: a})
+	}
+	return changes
+}
+
+func serialsOf(p *purchase) []string {
+	serials := []string{}
+	for _, l := range p.Items {
+		serials = append(serials, l.Serials...)
+	}
+	sort.Strings(serials)
+	return serials
+}
+
+// stockDelta is the change of stock between two receipts of a purchase, by
+// spec_id and dot_week, as lines for the store's adjust. Tyres received by
+// serial can be repriced but not added or removed.
+func stockDelta(before receipt, after receipt) ([]receiptLine, error) {
+	type deltaKey struct {
+		specID  int
+		dotWeek string
+		serials bool
+	}
+	sums := map[deltaKey]*receiptLine{}
+	order := []deltaKey{}
+	add := func(lines []receiptLine, sign int) {
+		for _, l := range lines {
+			k := deltaKey{l.SpecID, l.DotWeek, len(l.Serials) > 0}
+			d, ok := sums[k]
+			if !ok {
+				d = &receiptLine{SpecID: l.SpecID, DotWeek: l.DotWeek}
+				sums[k] = d
+				order = append(order, k)
+			}
+			d.How += sign * l.How
+			d.Money += float64(sign) * l.Money
+		}
+	}
+	add(before.Items, -1)
+	add(after.Items, 1)
+
+	delta := []receiptLine{}
+	for _, k := range order {
+		d := sums[k]
+		d.Money = round2(d.Money)
+		if k.serials && d.How != 0 {
+			return nil, fmt.Errorf("received of spec_id %d is counted by serials and can not be amended", k.specID)
+		}
+		if d.How == 0 && d.Money == 0 {
+			continue
+		}
+		delta = append(delta, *d)
+	}
+	return delta, nil
+}
+
+// ============================================================
+// amend - correct the supplier, currency or lines of a purchase that has
+// not been invoiced yet, as a new revision
+// args: the purchase as it should be, reason
+// ============================================================
+func (t *PurchaseChaincode) Amend(ctx contractapi.TransactionContextInterface, p purchase, reason string) (*revision, error) {
+	stub := ctx.GetStub()
+	var err error
+
+	// ==== Input sanitation ====
+	fmt.Println("- start amend")
+	if len(reason) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+	if p.CompanyID == "" {
+		return nil, errors.New("company_id must be required")
+	}
+	if p.OrderID == 0 {
+		return nil, errors.New("order_id must be required")
+	}
+	key := fmt.Sprintf("%s-%s", p.CompanyID, strconv.Itoa(p.OrderID))
+
+	oldAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get item: " + err.Error())
+	} else if oldAsBytes == nil {
+		return nil, errors.New("This item NOT exists: " + key)
+	}
+	var old purchase
+	if err := decodePurchase(oldAsBytes, &old); err != nil {
+		return nil, errors.New("Failed to decode JSON of: " + key)
+	}
+	if len(old.Invoiced) > 0 {
+		return nil, errors.New("The purchase " + key + " has been invoiced and can no longer be amended")
+	}
+	if old.Status == approvalPending || old.Status == approvalRejected {
+		return nil, errors.New("The purchase " + key + " is " + old.Status + " and can not be amended")
+	}
+	if err := checkPeriod(stub, old.CompanyID, old.AccTime); err != nil {
+		return nil, err
+	}
+	revealed, err := revealPrices(stub, key, &old)
+	if err != nil {
+		return nil, err
+	}
+	if !revealed {
+		return nil, errors.New("The prices of " + key + " are not visible to your organisation")
+	}
+
+	// ==== Only the supplier, currency and lines can change ====
+	p.TabNo = old.TabNo
+	p.RequestID = old.RequestID
+	p.AccTime = old.AccTime
+	p.Location = old.Location
+	p.Invoiced = nil
+	p.PriceCollection = ""
+	p.PriceHash = ""
+	p.Revision = old.Revision + 1
+	p.SchemaVersion = schemaVersion
+	p.Status = old.Status
+	p.RequiredRoles = old.RequiredRoles
+	p.Approvals = old.Approvals
+	specIDs := []string{}
+	for _, line := range p.Items {
+		if line.How <= 0 {
+			return nil, fmt.Errorf("how of spec_id %d must be positive", line.SpecID)
+		}
+		if line.Received < 0 || line.Received > line.How {
+			return nil, fmt.Errorf("received of spec_id %d must be between 0 and %d", line.SpecID, line.How)
+		}
+		specIDs = append(specIDs, strconv.Itoa(line.SpecID))
+	}
+	if !reflect.DeepEqual(serialsOf(&old), serialsOf(&p)) {
+		return nil, errors.New("serials can not be amended")
+	}
+	if err := readTransientPrices(stub, &p); err != nil {
+		return nil, err
+	}
+	if err := convertCurrency(stub, &p); err != nil {
+		return nil, err
+	}
+	entry, err := computeTax(stub, &p)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSpecs(stub, specIDs); err != nil {
+		return nil, err
+	}
+	if err := checkParty(stub, p.Client, "supplier"); err != nil {
+		return nil, err
+	}
+	// an amendment may not raise the purchase to a level that did not approve it
+	before, err := requiredRoles(stub, p.CompanyID, old.amount())
+	if err != nil {
+		return nil, err
+	}
+	after, err := requiredRoles(stub, p.CompanyID, p.amount())
+	if err != nil {
+		return nil, err
+	}
+	if len(after) > len(before) && len(after) > len(old.approvedRoles()) {
+		return nil, fmt.Errorf("The amended purchase %s needs approval by %s, create a new order", key, after[len(after)-1])
+	}
+
+	// ==== Book the net change of stock and cost ====
+	delta, err := stockDelta(old.receipt(), p.receipt())
+	if err != nil {
+		return nil, err
+	}
+	if len(delta) > 0 {
+		adjustment := p.receipt()
+		adjustment.Items = delta
+		adjustmentJSONasBytes, err := json.Marshal(adjustment)
+		if err != nil {
+			return nil, err
+		}
+		response := stub.InvokeChaincode(storeChaincode, [][]byte{[]byte("adjust"), adjustmentJSONasBytes}, "")
+		if response.Status != shim.OK {
+			return nil, errors.New("Failed to adjust store: " + response.Message)
+		}
+	}
+
+	// ==== Record the revision ====
+	editedBy, err := callerIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	rev := revision{
+		Key:        key,
+		Revision:   p.Revision,
+		EditedBy:   editedBy,
+		EditedTime: txTimestamp.Seconds,
+		TxID:       stub.GetTxID(),
+		Reason:     reason,
+		Lines:      diffLines(old.Items, p.Items),
+	}
+	if old.Client != p.Client {
+		rev.Fields = append(rev.Fields, fieldChange{Field: "client", Old: old.Client, New: p.Client})
+	}
+	if old.Currency != p.Currency {
+		rev.Fields = append(rev.Fields, fieldChange{Field: "currency", Old: old.Currency, New: p.Currency})
+	}
+	prices := revisionPrices{Before: pricedLines(&old), After: pricedLines(&p)}
+
+	if err := hidePrices(stub, key, &p); err != nil {
+		return nil, err
+	}
+	if err := putTaxEntry(stub, entry); err != nil {
+		return nil, err
+	}
+	if err := putRevision(stub, p.CompanyID, &rev, &prices); err != nil {
+		return nil, err
+	}
+
+	itemJSONasBytes, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := stub.PutState(key, itemJSONasBytes); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end amend")
+	return &rev, nil
+}
+
+func revisionKey(stub shim.ChaincodeStubInterface, key string, n int) (string, error) {
+	return stub.CreateCompositeKey("revision", []string{key, fmt.Sprintf("%06d", n)})
+}
+
+// putRevision stores a revision, its prices in the owner's collection.
+func putRevision(stub shim.ChaincodeStubInterface, companyID string, rev *revision, prices *revisionPrices) error {
+	revKey, err := revisionKey(stub, rev.Key, rev.Revision)
+	if err != nil {
+		return err
+	}
+	collection, err := priceCollection(stub, companyID)
+	if err != nil {
+		return err
+	}
+	pricesJSONasBytes, err := json.Marshal(prices)
+	if err != nil {
+		return err
+	}
+	if err := putPrivateByOwner(stub, companyID, collection, revKey, pricesJSONasBytes); err != nil {
+		return err
+	}
+	hash := sha256.Sum256(pricesJSONasBytes)
+	rev.PriceHash = hex.EncodeToString(hash[:])
+	rev.PriceCollection = collection
+
+	revJSONasBytes, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	return putWithDocument(stub, rev.Key, revKey, revJSONasBytes)
+}
+
+// ==================================================
+// revisions - the amendments of a purchase, oldest first, with their prices
+// for members of the company's owner
+// ==================================================
+func (t *PurchaseChaincode) Revisions(ctx contractapi.TransactionContextInterface, key string) ([]revision, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start revisions")
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("revision", []string{key})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	revs := []revision{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var rev revision
+		if err := json.Unmarshal(response.Value, &rev); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		if rev.PriceCollection != "" {
+			pricesAsBytes, err := stub.GetPrivateData(rev.PriceCollection, response.Key)
+			if err == nil && pricesAsBytes != nil {
+				hash := sha256.Sum256(pricesAsBytes)
+				if hex.EncodeToString(hash[:]) != rev.PriceHash {
+					return nil, errors.New("The prices of revision " + strconv.Itoa(rev.Revision) + " do not match their hash")
+				}
+				rev.Prices = &revisionPrices{}
+				if err := json.Unmarshal(pricesAsBytes, rev.Prices); err != nil {
+					return nil, errors.New("Failed to decode JSON of prices: " + response.Key)
+				}
+			}
+		}
+		revs = append(revs, rev)
+	}
+
+	fmt.Println("- end revisions")
+	return revs, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Approval statuses of a purchase. Purchases from before approvals, and
+// those below every threshold, are approved when created.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+)
+
+// approvalLevel requires the role to approve purchases of at least
+// threshold, in base currency before tax.
+type approvalLevel struct {
+	Threshold float64 `json:"threshold"`
+	Role      string  `json:"role"`
+}
+
+// approvalPolicy of a company. A purchase needs the approval of every level
+// it reaches, lowest threshold first.
+type approvalPolicy struct {
+	CompanyID string          `json:"company_id"`
+	Levels    []approvalLevel `json:"levels"`
+}
+
+// approvalStep is one decision in the approval history of a purchase.
+type approvalStep struct {
+	Role     string `json:"role"`
+	By       string `json:"by"`
+	Time     int64  `json:"time"`
+	Decision string `json:"decision"`
+	Comment  string `json:"comment,omitempty" metadata:",optional"`
+}
+
+// amount is the base currency value of the ordered lines, before tax.
+func (p *purchase) amount() float64 {
+	var total float64
+	for _, l := range p.Items {
+		total += l.BaseMoney
+	}
+	return round2(total)
+}
+
+func approvalPolicyKey(stub shim.ChaincodeStubInterface, companyID string) (string, error) {
+	return stub.CreateCompositeKey("approval", []string{companyID})
+}
+
+func getApprovalPolicy(stub shim.ChaincodeStubInterface, companyID string) (*approvalPolicy, error) {
+	key, err := approvalPolicyKey(stub, companyID)
+	if err != nil {
+		return nil, err
+	}
+	policyAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	policy := &approvalPolicy{CompanyID: companyID, Levels: []approvalLevel{}}
+	if policyAsBytes == nil {
+		return policy, nil
+	}
+	if err := json.Unmarshal(policyAsBytes, policy); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", key)
+	}
+	return policy, nil
+}
+
+// requiredRoles are the roles that must approve a purchase of amount, in
+// order.
+func requiredRoles(stub shim.ChaincodeStubInterface, companyID string, amount float64) ([]string, error) {
+	policy, err := getApprovalPolicy(stub, companyID)
+	if err != nil {
+		return nil, err
+	}
+	roles := []string{}
+	for _, level := range policy.Levels {
+		if amount >= level.Threshold {
+			roles = append(roles, level.Role)
+		}
+	}
+	return roles, nil
+}
+
+// approvedRoles are the roles that have approved a purchase so far.
+func (p *purchase) approvedRoles() []string {
+	roles := []string{}
+	for _, step := range p.Approvals {
+		if step.Decision == approvalApproved {
+			roles = append(roles, step.Role)
+		}
+	}
+	return roles
+}
+
+// ============================================================
+// setApprovalPolicy - the approval levels of a company
+// args: company_id, [{"threshold": 10000, "role": "branch_manager"}, ...]
+// ============================================================
+func (t *PurchaseChaincode) SetApprovalPolicy(ctx contractapi.TransactionContextInterface, companyID string, levels []approvalLevel) error {
+	stub := ctx.GetStub()
+	fmt.Println("- start setApprovalPolicy")
+	if len(companyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
+	}
+	policy := approvalPolicy{CompanyID: companyID, Levels: levels}
+	sort.SliceStable(policy.Levels, func(i, j int) bool { return policy.Levels[i].Threshold < policy.Levels[j].Threshold })
+	for _, level := range policy.Levels {
+		if level.Threshold < 0 {
+			return errors.New("threshold must not be negative")
+		}
+		if level.Role == "" {
+			return errors.New("role must be required")
+		}
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a " + managerRole + " may set the approval policy")
+	}
+
+	key, err := approvalPolicyKey(stub, policy.CompanyID)
+	if err != nil {
+		return err
+	}
+	policyJSONasBytes, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	if err := putByOwner(stub, policy.CompanyID, key, policyJSONasBytes); err != nil {
+		return err
+	}
+
+	fmt.Println("- end setApprovalPolicy")
+	return nil
+}
+
+// ==================================================
+// queryApprovalPolicy - the approval levels of a company
+// ==================================================
+func (t *PurchaseChaincode) QueryApprovalPolicy(ctx contractapi.TransactionContextInterface, companyID string) (*approvalPolicy, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start queryApprovalPolicy")
+	policy, err := getApprovalPolicy(stub, companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end queryApprovalPolicy")
+	return policy, nil
+}
+
+// ============================================================
+// decide - approve or reject a pending purchase at its next level. The
+// caller's certificate must carry the role of that level. The last approval
+// receives the purchase into stock and books its input tax.
+// args: key, comment (required to reject)
+// ============================================================
+func (t *PurchaseChaincode) decide(ctx contractapi.TransactionContextInterface, key string, comment string, decision string) (*purchase, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start decide " + decision)
+	if len(key) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+	if decision == approvalRejected && comment == "" {
+		return nil, errors.New("A reason is required to reject a purchase")
+	}
+
+	itemAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get item: " + err.Error())
+	} else if itemAsBytes == nil {
+		return nil, errors.New("This item NOT exists: " + key)
+	}
+	var p purchase
+	if err := decodePurchase(itemAsBytes, &p); err != nil {
+		return nil, errors.New("Failed to decode JSON of: " + key)
+	}
+	if p.Status != approvalPending {
+		return nil, errors.New("The purchase " + key + " is not pending approval")
+	}
+	if err := checkPeriod(stub, p.CompanyID, p.AccTime); err != nil {
+		return nil, err
+	}
+
+	// ==== The caller must hold the role of the next level ====
+	role := p.RequiredRoles[len(p.approvedRoles())]
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, role); err != nil {
+		return nil, errors.New("The purchase " + key + " is waiting for approval by " + role)
+	}
+	by, err := callerIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range p.Approvals {
+		if step.By == by {
+			return nil, errors.New(by + " has already approved " + key)
+		}
+	}
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	p.Approvals = append(p.Approvals, approvalStep{
+		Role:     role,
+		By:       by,
+		Time:     txTimestamp.Seconds,
+		Decision: decision,
+		Comment:  comment,
+	})
+
+	if decision == approvalRejected {
+		p.Status = approvalRejected
+	} else if len(p.approvedRoles()) == len(p.RequiredRoles) {
+		p.Status = approvalApproved
+
+		// ==== Receive the approved lines at their private prices ====
+		priced := p
+		priced.Items = append([]subPurchase(nil), p.Items...)
+		revealed, err := revealPrices(stub, key, &priced)
+		if err != nil {
+			return nil, err
+		} else if !revealed {
+			return nil, errors.New("The prices of " + key + " are not visible to your organisation")
+		}
+		entry, err := computeTax(stub, &priced)
+		if err != nil {
+			return nil, err
+		}
+		receiptJSONasBytes, err := json.Marshal(priced.receipt())
+		if err != nil {
+			return nil, err
+		}
+		response := stub.InvokeChaincode(storeChaincode, [][]byte{[]byte("receive"), receiptJSONasBytes}, "")
+		if response.Status != shim.OK {
+			return nil, errors.New("Failed to receive into store: " + response.Message)
+		}
+		if err := putTaxEntry(stub, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	itemJSONasBytes, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := stub.PutState(key, itemJSONasBytes); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end decide " + decision)
+	return &p, nil
+}
+
+// Approve a pending purchase at its next level.
+func (t *PurchaseChaincode) Approve(ctx contractapi.TransactionContextInterface, key string, comment string) (*purchase, error) {
+	return t.decide(ctx, key, comment, approvalApproved)
+}
+
+// Reject a pending purchase at its next level.
+func (t *PurchaseChaincode) Reject(ctx contractapi.TransactionContextInterface, key string, comment string) (*purchase, error) {
+	return t.decide(ctx, key, comment, approvalRejected)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// baseCurrency is the currency the books are kept in. Stock is received
+// into the store at base currency cost, so its reports total in it.
+const baseCurrency = "CNY"
+
+// Callers whose certificate carries role=finance maintain exchange rates.
+const financeRole = "finance"
+
+// rate is how many units of base currency one unit of currency bought from
+// date on, until a later rate is set.
+type rate struct {
+	Currency string  `json:"currency"`
+	Date     string  `json:"date"`
+	Rate     float64 `json:"rate"`
+	SetBy    string  `json:"set_by"`
+}
+
+// rateDate is the UTC day of a unix time as YYYYMMDD.
+func rateDate(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format("20060102")
+}
+
+func validCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, c := range currency {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// getRate returns the latest rate of currency set on or before the day of
+// accTime. The base currency is always 1.
+func getRate(stub shim.ChaincodeStubInterface, currency string, accTime int64) (float64, error) {
+	if currency == baseCurrency {
+		return 1, nil
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("rate", []string{currency})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	date := rateDate(accTime)
+	var found *rate
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		var r rate
+		if err := json.Unmarshal(response.Value, &r); err != nil {
+			return 0, fmt.Errorf("Failed to decode JSON of: %s", response.Key)
+		}
+		// keys are ordered by date, so stop at the first later rate
+		if r.Date > date {
+			break
+		}
+		found = &r
+	}
+	if found == nil {
+		return 0, fmt.Errorf("No %s rate set on or before %s", currency, date)
+	}
+	return found.Rate, nil
+}
+
+// convertCurrency fills in the currency of a purchase and its lines and
+// the base currency money of each line at the rate of acc_time.
+func convertCurrency(stub shim.ChaincodeStubInterface, p *purchase) error {
+	p.Currency = strings.ToUpper(p.Currency)
+	if p.Currency == "" {
+		p.Currency = baseCurrency
+	}
+	if !validCurrency(p.Currency) {
+		return fmt.Errorf("currency %s must be a 3 letter ISO code", p.Currency)
+	}
+	c, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if err := c.checkCurrency(p.Currency); err != nil {
+		return err
+	}
+
+	rates := map[string]float64{}
+	for i := range p.Items {
+		l := &p.Items[i]
+		l.Currency = strings.ToUpper(l.Currency)
+		if l.Currency == "" {
+			l.Currency = p.Currency
+		}
+		if !validCurrency(l.Currency) {
+			return fmt.Errorf("currency %s of spec_id %d must be a 3 letter ISO code", l.Currency, l.SpecID)
+		}
+		if err := c.checkCurrency(l.Currency); err != nil {
+			return err
+		}
+		r, ok := rates[l.Currency]
+		if !ok {
+			r, err = getRate(stub, l.Currency, p.AccTime)
+			if err != nil {
+				return err
+			}
+			rates[l.Currency] = r
+		}
+		l.BaseMoney = round2(l.Money * r)
+	}
+	return nil
+}
+
+// ============================================================
+// setRate - set the rate of a currency from a date on
+// ============================================================
+func (t *PurchaseChaincode) SetRate(ctx contractapi.TransactionContextInterface, currency string, date string, value float64) error {
+	stub := ctx.GetStub()
+	// ==== Input sanitation ====
+	fmt.Println("- start setRate")
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, financeRole); err != nil {
+		return errors.New("Only " + financeRole + " may set exchange rates")
+	}
+	currency = strings.ToUpper(currency)
+	if !validCurrency(currency) || currency == baseCurrency {
+		return errors.New("1st argument must be a 3 letter ISO code other than " + baseCurrency)
+	}
+	if _, err := time.Parse("20060102", date); err != nil {
+		return errors.New("2nd argument must be a date YYYYMMDD")
+	}
+	if value <= 0 {
+		return errors.New("3rd argument must be a positive number")
+	}
+
+	setBy, err := callerIdentity(stub)
+	if err != nil {
+		return err
+	}
+	key, err := stub.CreateCompositeKey("rate", []string{currency, date})
+	if err != nil {
+		return err
+	}
+	rateJSONasBytes, err := json.Marshal(rate{Currency: currency, Date: date, Rate: value, SetBy: setBy})
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, rateJSONasBytes); err != nil {
+		return err
+	}
+
+	fmt.Println("- end setRate")
+	return nil
+}
+
+// ==================================================
+// queryRate - rate of a currency in effect at a unix time
+// ==================================================
+func (t *PurchaseChaincode) QueryRate(ctx contractapi.TransactionContextInterface, currency string, accTime int64) (float64, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start queryRate")
+	value, err := getRate(stub, strings.ToUpper(currency), accTime)
+	if err != nil {
+		return 0, err
+	}
+
+	fmt.Println("- end queryRate")
+	return value, nil
+}
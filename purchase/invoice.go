@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Callers whose certificate carries role=manager may approve an invoice
+// that does not match its purchase.
+const (
+	roleAttribute = "role"
+	managerRole   = "manager"
+)
+
+// Match and payment status of a supplier invoice.
+const (
+	matchOK          = "matched"
+	matchDiscrepancy = "discrepancy"
+
+	statusUnpaid  = "unpaid"
+	statusPartial = "partial"
+	statusPaid    = "paid"
+)
+
+type invoiceLine struct {
+	SpecID int     `json:"spec_id"`
+	How    int     `json:"how"`
+	Money  float64 `json:"money"`
+}
+
+// matchLine compares one spec_id of a purchase as ordered, as received and
+// as invoiced so far including this invoice.
+type matchLine struct {
+	SpecID        int      `json:"spec_id"`
+	Ordered       int      `json:"ordered"`
+	Received      int      `json:"received"`
+	Invoiced      int      `json:"invoiced"`
+	InvoicePrice  float64  `json:"invoice_price"`
+	Discrepancies []string `json:"discrepancies,omitempty" metadata:",optional"`
+}
+
+// supplierInvoice is recorded by createInvoice from the fields up to items;
+// the amount, match and payment status are computed.
+type supplierInvoice struct {
+	CompanyID   string        `json:"company_id"`
+	InvoiceID   string        `json:"invoice_id"`
+	OrderID     int           `json:"order_id"`
+	Client      string        `json:"client"`
+	InvoiceTime int64         `json:"invoice_time"`
+	Currency    string        `json:"currency,omitempty" metadata:",optional"`
+	Items       []invoiceLine `json:"items"`
+	Amount      float64       `json:"amount" metadata:",optional"`
+	Match       string        `json:"match" metadata:",optional"`
+	MatchLines  []matchLine   `json:"match_lines,omitempty" metadata:",optional"`
+	ApprovedBy  string        `json:"approved_by,omitempty" metadata:",optional"`
+	Paid        float64       `json:"paid" metadata:",optional"`
+	Outstanding float64       `json:"outstanding" metadata:",optional"`
+	Status      string        `json:"status" metadata:",optional"`
+}
+
+type supplierPayment struct {
+	CompanyID string  `json:"company_id"`
+	PaymentID string  `json:"payment_id"`
+	InvoiceID string  `json:"invoice_id"`
+	PayTime   int64   `json:"pay_time"`
+	Amount    float64 `json:"amount"`
+}
+
+// tolerance is how far, in percent, invoiced quantity may exceed received
+// quantity and invoice price may differ from order price before an invoice
+// is flagged. Companies without a tolerance use the one of the configuration
+// and otherwise match exactly.
+type tolerance struct {
+	QtyPct   float64 `json:"qty_pct"`
+	PricePct float64 `json:"price_pct"`
+}
+
+func invoiceKey(stub shim.ChaincodeStubInterface, companyID string, invoiceID string) (string, error) {
+	return stub.CreateCompositeKey("invoice", []string{companyID, invoiceID})
+}
+
+func getInvoice(stub shim.ChaincodeStubInterface, companyID string, invoiceID string) (*supplierInvoice, error) {
+	key, err := invoiceKey(stub, companyID, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	invoiceAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get invoice: %s", err.Error())
+	} else if invoiceAsBytes == nil {
+		return nil, fmt.Errorf("This invoice NOT exists: %s-%s", companyID, invoiceID)
+	}
+	var inv supplierInvoice
+	if err := json.Unmarshal(invoiceAsBytes, &inv); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s-%s", companyID, invoiceID)
+	}
+	return &inv, nil
+}
+
+func putInvoice(stub shim.ChaincodeStubInterface, inv *supplierInvoice) error {
+	key, err := invoiceKey(stub, inv.CompanyID, inv.InvoiceID)
+	if err != nil {
+		return err
+	}
+	invoiceJSONasBytes, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return putByOwner(stub, inv.CompanyID, key, invoiceJSONasBytes)
+}
+
+func getTolerance(stub shim.ChaincodeStubInterface, companyID string) (*tolerance, error) {
+	key, err := stub.CreateCompositeKey("tolerance", []string{companyID})
+	if err != nil {
+		return nil, err
+	}
+	toleranceAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	tol := &tolerance{}
+	if toleranceAsBytes == nil {
+		c, err := getConfig(stub)
+		if err != nil {
+			return nil, err
+		}
+		if c.Tolerance != nil {
+			*tol = *c.Tolerance
+		}
+		return tol, nil
+	}
+	if err := json.Unmarshal(toleranceAsBytes, tol); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", key)
+	}
+	return tol, nil
+}
+
+// applyPayment sets outstanding and status of an invoice after paid has
+// changed.
+func (inv *supplierInvoice) applyPayment() {
+	inv.Outstanding = round2(inv.Amount - inv.Paid)
+	switch {
+	case inv.Paid == 0:
+		inv.Status = statusUnpaid
+	case inv.Outstanding > 0:
+		inv.Status = statusPartial
+	default:
+		inv.Status = statusPaid
+	}
+}
+
+// threeWayMatch compares the invoice against the purchase per spec_id and
+// adds its quantities to what has been invoiced on the purchase.
+func threeWayMatch(p *purchase, inv *supplierInvoice, tol *tolerance) {
+	lines := map[int]*matchLine{}
+	line := func(specID int) *matchLine {
+		l, ok := lines[specID]
+		if !ok {
+			l = &matchLine{SpecID: specID}
+			lines[specID] = l
+		}
+		return l
+	}
+
+	orderMoney := map[int]float64{}
+	for _, pl := range p.Items {
+		l := line(pl.SpecID)
+		l.Ordered += pl.How
+		l.Received += pl.Received
+		orderMoney[pl.SpecID] += pl.Money
+	}
+	invoiceMoney := map[int]float64{}
+	invoiceHow := map[int]int{}
+	for _, il := range inv.Items {
+		invoiceMoney[il.SpecID] += il.Money
+		invoiceHow[il.SpecID] += il.How
+	}
+	if p.Invoiced == nil {
+		p.Invoiced = map[string]int{}
+	}
+	for specID, how := range invoiceHow {
+		p.Invoiced[strconv.Itoa(specID)] += how
+		line(specID)
+	}
+
+	inv.Match = matchOK
+	inv.MatchLines = []matchLine{}
+	for specID, l := range lines {
+		l.Invoiced = p.Invoiced[strconv.Itoa(specID)]
+		orderPrice := 0.0
+		if l.Ordered > 0 {
+			orderPrice = round2(orderMoney[specID] / float64(l.Ordered))
+		}
+		if invoiceHow[specID] > 0 {
+			l.InvoicePrice = round2(invoiceMoney[specID] / float64(invoiceHow[specID]))
+		}
+
+		if l.Ordered == 0 {
+			l.Discrepancies = append(l.Discrepancies, "not ordered")
+		}
+		if float64(l.Invoiced) > float64(l.Received)*(1+tol.QtyPct/100) {
+			l.Discrepancies = append(l.Discrepancies, fmt.Sprintf("invoiced %d, received %d", l.Invoiced, l.Received))
+		}
+		// the order price is private, so the invoice only says it differs
+		if invoiceHow[specID] > 0 && l.Ordered > 0 &&
+			math.Abs(l.InvoicePrice-orderPrice) > orderPrice*tol.PricePct/100 {
+			l.Discrepancies = append(l.Discrepancies, "invoice price differs from order price")
+		}
+		if len(l.Discrepancies) > 0 {
+			inv.Match = matchDiscrepancy
+		}
+		// only the specs on this invoice are reported
+		if invoiceHow[specID] > 0 {
+			inv.MatchLines = append(inv.MatchLines, *l)
+		}
+	}
+	sort.Slice(inv.MatchLines, func(a, b int) bool { return inv.MatchLines[a].SpecID < inv.MatchLines[b].SpecID })
+}
+
+// ============================================================
+// createInvoice - record a supplier invoice against a purchase
+// ============================================================
+func (t *PurchaseChaincode) CreateInvoice(ctx contractapi.TransactionContextInterface, inv supplierInvoice) (*supplierInvoice, error) {
+	stub := ctx.GetStub()
+	var err error
+
+	// ==== Input sanitation ====
+	fmt.Println("- start createInvoice")
+	if inv.CompanyID == "" {
+		return nil, errors.New("company_id must be required")
+	}
+	if inv.InvoiceID == "" {
+		return nil, errors.New("invoice_id must be required")
+	}
+	if inv.OrderID == 0 {
+		return nil, errors.New("order_id must be required")
+	}
+	for _, il := range inv.Items {
+		if il.How <= 0 {
+			return nil, fmt.Errorf("how of spec_id %d must be positive", il.SpecID)
+		}
+	}
+	if err := checkPeriod(stub, inv.CompanyID, inv.InvoiceTime); err != nil {
+		return nil, err
+	}
+
+	key, err := invoiceKey(stub, inv.CompanyID, inv.InvoiceID)
+	if err != nil {
+		return nil, err
+	}
+	invoiceAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get invoice: " + err.Error())
+	} else if invoiceAsBytes != nil {
+		msg := fmt.Sprintf("The invoice %s-%s has already existed!", inv.CompanyID, inv.InvoiceID)
+		return nil, errors.New(msg)
+	}
+
+	purchaseKey := fmt.Sprintf("%s-%s", inv.CompanyID, strconv.Itoa(inv.OrderID))
+	purchaseAsBytes, err := stub.GetState(purchaseKey)
+	if err != nil {
+		return nil, errors.New("Failed to get item: " + err.Error())
+	} else if purchaseAsBytes == nil {
+		return nil, errors.New("This item NOT exists: " + purchaseKey)
+	}
+	var p purchase
+	if err := decodePurchase(purchaseAsBytes, &p); err != nil {
+		return nil, err
+	}
+	revealed, err := revealPrices(stub, purchaseKey, &p)
+	if err != nil {
+		return nil, err
+	} else if !revealed {
+		return nil, errors.New("The prices of " + purchaseKey + " are not visible to your organisation")
+	}
+	if p.Status == approvalPending || p.Status == approvalRejected {
+		return nil, errors.New("The purchase " + purchaseKey + " is " + p.Status + ", not approved")
+	}
+	if inv.Client != p.Client {
+		return nil, fmt.Errorf("The purchase %s was bought from %s, not %s", purchaseKey, p.Client, inv.Client)
+	}
+	// purchases from before currencies were recorded are in base currency
+	if p.Currency == "" {
+		p.Currency = baseCurrency
+	}
+	inv.Currency = strings.ToUpper(inv.Currency)
+	if inv.Currency == "" {
+		inv.Currency = p.Currency
+	}
+	if inv.Currency != p.Currency {
+		return nil, fmt.Errorf("The purchase %s is in %s, not %s", purchaseKey, p.Currency, inv.Currency)
+	}
+
+	tol, err := getTolerance(stub, inv.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+	threeWayMatch(&p, &inv, tol)
+
+	inv.Amount = 0
+	for _, il := range inv.Items {
+		inv.Amount += il.Money
+	}
+	inv.Amount = round2(inv.Amount)
+	inv.ApprovedBy = ""
+	inv.Paid = 0
+	inv.applyPayment()
+
+	if err := putInvoice(stub, &inv); err != nil {
+		return nil, err
+	}
+	// only the invoiced quantities change, the prices stay private
+	if p.PriceCollection != "" {
+		for i := range p.Items {
+			p.Items[i].Money = 0
+			p.Items[i].BaseMoney = 0
+			p.Items[i].Tax = 0
+		}
+	}
+	purchaseJSONasBytes, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := stub.PutState(purchaseKey, purchaseJSONasBytes); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end createInvoice")
+	return &inv, nil
+}
+
+// ============================================================
+// approveInvoice - let a manager release an invoice with discrepancies
+// ============================================================
+func (t *PurchaseChaincode) ApproveInvoice(ctx contractapi.TransactionContextInterface, companyID string, invoiceID string) error {
+	stub := ctx.GetStub()
+	fmt.Println("- start approveInvoice")
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a " + managerRole + " may approve an invoice")
+	}
+
+	inv, err := getInvoice(stub, companyID, invoiceID)
+	if err != nil {
+		return err
+	}
+	if inv.Match != matchDiscrepancy {
+		return errors.New("The invoice " + companyID + "-" + invoiceID + " has no discrepancies")
+	}
+	inv.ApprovedBy, err = callerIdentity(stub)
+	if err != nil {
+		return err
+	}
+
+	if err := putInvoice(stub, inv); err != nil {
+		return err
+	}
+
+	fmt.Println("- end approveInvoice")
+	return nil
+}
+
+// ============================================================
+// payInvoice - record a payment of a supplier invoice
+// ============================================================
+func (t *PurchaseChaincode) PayInvoice(ctx contractapi.TransactionContextInterface, sp supplierPayment) error {
+	stub := ctx.GetStub()
+	var err error
+
+	// ==== Input sanitation ====
+	fmt.Println("- start payInvoice")
+	if sp.CompanyID == "" {
+		return errors.New("company_id must be required")
+	}
+	if sp.PaymentID == "" {
+		return errors.New("payment_id must be required")
+	}
+	if sp.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	if err := checkPeriod(stub, sp.CompanyID, sp.PayTime); err != nil {
+		return err
+	}
+
+	key, err := stub.CreateCompositeKey("payment", []string{sp.CompanyID, sp.PaymentID})
+	if err != nil {
+		return err
+	}
+	paymentAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errors.New("Failed to get payment: " + err.Error())
+	} else if paymentAsBytes != nil {
+		msg := fmt.Sprintf("The payment %s-%s has already existed!", sp.CompanyID, sp.PaymentID)
+		return errors.New(msg)
+	}
+
+	inv, err := getInvoice(stub, sp.CompanyID, sp.InvoiceID)
+	if err != nil {
+		return err
+	}
+	if inv.Match == matchDiscrepancy && inv.ApprovedBy == "" {
+		return errors.New("The invoice " + sp.CompanyID + "-" + sp.InvoiceID + " does not match its purchase")
+	}
+	if round2(sp.Amount) > inv.Outstanding {
+		return fmt.Errorf("The invoice %s-%s has only %.2f outstanding", sp.CompanyID, sp.InvoiceID, inv.Outstanding)
+	}
+	inv.Paid = round2(inv.Paid + sp.Amount)
+	inv.applyPayment()
+
+	if err := putInvoice(stub, inv); err != nil {
+		return err
+	}
+	paymentJSONasBytes, err := json.Marshal(sp)
+	if err != nil {
+		return err
+	}
+	if err := putByOwner(stub, sp.CompanyID, key, paymentJSONasBytes); err != nil {
+		return err
+	}
+
+	fmt.Println("- end payInvoice")
+	return nil
+}
+
+// ==================================================
+// queryInvoice - query a supplier invoice by company and ID
+// ==================================================
+func (t *PurchaseChaincode) QueryInvoice(ctx contractapi.TransactionContextInterface, companyID string, invoiceID string) (*supplierInvoice, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start queryInvoice")
+	inv, err := getInvoice(stub, companyID, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end queryInvoice")
+	return inv, nil
+}
+
+// ============================================================
+// setTolerance - set the three-way match tolerance of a company
+// ============================================================
+func (t *PurchaseChaincode) SetTolerance(ctx contractapi.TransactionContextInterface, companyID string, qtyPct float64, pricePct float64) error {
+	stub := ctx.GetStub()
+	// ==== Input sanitation ====
+	fmt.Println("- start setTolerance")
+	if len(companyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
+	}
+	if qtyPct < 0 {
+		return errors.New("2nd argument must be a non-negative number")
+	}
+	if pricePct < 0 {
+		return errors.New("3rd argument must be a non-negative number")
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a " + managerRole + " may set the tolerance")
+	}
+
+	key, err := stub.CreateCompositeKey("tolerance", []string{companyID})
+	if err != nil {
+		return err
+	}
+	toleranceJSONasBytes, err := json.Marshal(tolerance{QtyPct: qtyPct, PricePct: pricePct})
+	if err != nil {
+		return err
+	}
+	if err := putByOwner(stub, companyID, key, toleranceJSONasBytes); err != nil {
+		return err
+	}
+
+	fmt.Println("- end setTolerance")
+	return nil
+}
+
+// callerIdentity names the submitter as MSP ID and certificate common name,
+// e.g. "Org1MSP/Jim".
+func callerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + cert.Subject.CommonName, nil
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
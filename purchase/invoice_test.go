@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestThreeWayMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		items    []subPurchase
+		invoiced map[string]int
+		lines    []invoiceLine
+		tol      tolerance
+		match    string
+		want     []matchLine
+		total    map[string]int
+	}{
+		{
+			name:  "as ordered and received",
+			items: []subPurchase{{SpecID: 1111, How: 10, Received: 10, Money: 1000}},
+			lines: []invoiceLine{{SpecID: 1111, How: 10, Money: 1000}},
+			match: matchOK,
+			want:  []matchLine{{SpecID: 1111, Ordered: 10, Received: 10, Invoiced: 10, InvoicePrice: 100}},
+			total: map[string]int{"1111": 10},
+		},
+		{
+			name:  "invoiced more than received",
+			items: []subPurchase{{SpecID: 1111, How: 10, Received: 8, Money: 1000}},
+			lines: []invoiceLine{{SpecID: 1111, How: 10, Money: 1000}},
+			match: matchDiscrepancy,
+			want: []matchLine{{SpecID: 1111, Ordered: 10, Received: 8, Invoiced: 10, InvoicePrice: 100,
+				Discrepancies: []string{"invoiced 10, received 8"}}},
+			total: map[string]int{"1111": 10},
+		},
+		{
+			name:  "quantity within tolerance",
+			items: []subPurchase{{SpecID: 1111, How: 100, Received: 100, Money: 10000}},
+			lines: []invoiceLine{{SpecID: 1111, How: 102, Money: 10200}},
+			tol:   tolerance{QtyPct: 2},
+			match: matchOK,
+			want:  []matchLine{{SpecID: 1111, Ordered: 100, Received: 100, Invoiced: 102, InvoicePrice: 100}},
+			total: map[string]int{"1111": 102},
+		},
+		{
+			name:  "price outside tolerance",
+			items: []subPurchase{{SpecID: 1111, How: 10, Received: 10, Money: 1000}},
+			lines: []invoiceLine{{SpecID: 1111, How: 10, Money: 1100}},
+			tol:   tolerance{PricePct: 5},
+			match: matchDiscrepancy,
+			want: []matchLine{{SpecID: 1111, Ordered: 10, Received: 10, Invoiced: 10, InvoicePrice: 110,
+				Discrepancies: []string{"invoice price differs from order price"}}},
+			total: map[string]int{"1111": 10},
+		},
+		{
+			name:  "price within tolerance",
+			items: []subPurchase{{SpecID: 1111, How: 10, Received: 10, Money: 1000}},
+			lines: []invoiceLine{{SpecID: 1111, How: 10, Money: 1100}},
+			tol:   tolerance{PricePct: 10},
+			match: matchOK,
+			want:  []matchLine{{SpecID: 1111, Ordered: 10, Received: 10, Invoiced: 10, InvoicePrice: 110}},
+			total: map[string]int{"1111": 10},
+		},
+		{
+			name:  "spec not ordered",
+			items: []subPurchase{{SpecID: 1111, How: 10, Received: 10, Money: 1000}},
+			lines: []invoiceLine{{SpecID: 2222, How: 1, Money: 50}},
+			match: matchDiscrepancy,
+			want: []matchLine{{SpecID: 2222, Invoiced: 1, InvoicePrice: 50,
+				Discrepancies: []string{"not ordered", "invoiced 1, received 0"}}},
+			total: map[string]int{"2222": 1},
+		},
+		{
+			name:     "earlier invoices count",
+			items:    []subPurchase{{SpecID: 1111, How: 10, Received: 10, Money: 1000}},
+			invoiced: map[string]int{"1111": 6},
+			lines:    []invoiceLine{{SpecID: 1111, How: 6, Money: 600}},
+			match:    matchDiscrepancy,
+			want: []matchLine{{SpecID: 1111, Ordered: 10, Received: 10, Invoiced: 12, InvoicePrice: 100,
+				Discrepancies: []string{"invoiced 12, received 10"}}},
+			total: map[string]int{"1111": 12},
+		},
+		{
+			name: "only the invoiced specs",
+			items: []subPurchase{
+				{SpecID: 2222, How: 4, Received: 4, Money: 400},
+				{SpecID: 1111, How: 10, Received: 10, Money: 1000},
+				{SpecID: 1111, How: 10, Received: 10, Money: 1000},
+			},
+			lines: []invoiceLine{{SpecID: 1111, How: 5, Money: 500}, {SpecID: 1111, How: 15, Money: 1500}},
+			match: matchOK,
+			want:  []matchLine{{SpecID: 1111, Ordered: 20, Received: 20, Invoiced: 20, InvoicePrice: 100}},
+			total: map[string]int{"1111": 20},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := purchase{CompanyID: "3", OrderID: 10, Items: tt.items, Invoiced: tt.invoiced}
+			inv := supplierInvoice{CompanyID: "3", InvoiceID: "INV-1", OrderID: 10, Items: tt.lines}
+			tol := tt.tol
+
+			threeWayMatch(&p, &inv, &tol)
+			if inv.Match != tt.match {
+				t.Errorf("match = %s, want %s", inv.Match, tt.match)
+			}
+			if !reflect.DeepEqual(inv.MatchLines, tt.want) {
+				t.Errorf("match lines = %+v, want %+v", inv.MatchLines, tt.want)
+			}
+			if !reflect.DeepEqual(p.Invoiced, tt.total) {
+				t.Errorf("invoiced = %v, want %v", p.Invoiced, tt.total)
+			}
+		})
+	}
+}
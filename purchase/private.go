@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// pricesTransientKey is the transient field create reads the line prices
+// from, so they never appear in the proposal written to the block.
+const pricesTransientKey = "prices"
+
+// pricedLine is the money of one purchase line, kept only in the private
+// data collection of the company's owner.
+type pricedLine struct {
+	SpecID    int     `json:"spec_id"`
+	How       int     `json:"how"`
+	Money     float64 `json:"money"`
+	BaseMoney float64 `json:"base_money"`
+	Tax       float64 `json:"tax"`
+}
+
+type purchasePrices struct {
+	CompanyID string       `json:"company_id"`
+	OrderID   int          `json:"order_id"`
+	Items     []pricedLine `json:"items"`
+}
+
+// priceCollection is the private data collection of the owner of a
+// company, e.g. "Org1MSPPrices", holding the prices, revision prices and tax
+// entries of its purchases. Each organisation's collection is defined in
+// collections_config.json with only that organisation as member.
+func priceCollection(stub shim.ChaincodeStubInterface, companyID string) (string, error) {
+	mspID, err := ownerOf(stub, companyID)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "Prices", nil
+}
+
+// readTransientPrices sets the money of the purchase lines from the
+// transient "prices" field, a list of {spec_id, money} in line order. The
+// public argument may not carry money.
+func readTransientPrices(stub shim.ChaincodeStubInterface, p *purchase) error {
+	for _, line := range p.Items {
+		if line.Money != 0 {
+			return errors.New("money must be passed in the transient field " + pricesTransientKey)
+		}
+	}
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return err
+	}
+	pricesAsBytes, ok := transient[pricesTransientKey]
+	if !ok {
+		return nil
+	}
+
+	var prices []pricedLine
+	if err := json.Unmarshal(pricesAsBytes, &prices); err != nil {
+		return fmt.Errorf("Invalid json format of transient %s", pricesTransientKey)
+	}
+	if len(prices) != len(p.Items) {
+		return fmt.Errorf("transient %s has %d lines, the purchase has %d", pricesTransientKey, len(prices), len(p.Items))
+	}
+	for i := range p.Items {
+		if prices[i].SpecID != p.Items[i].SpecID {
+			return fmt.Errorf("transient %s line %d is spec_id %d, not %d", pricesTransientKey, i+1, prices[i].SpecID, p.Items[i].SpecID)
+		}
+		p.Items[i].Money = prices[i].Money
+	}
+	return nil
+}
+
+// hidePrices moves the money of a purchase into the owner's private
+// collection and leaves its hash and the collection name on the purchase.
+func hidePrices(stub shim.ChaincodeStubInterface, key string, p *purchase) error {
+	collection, err := priceCollection(stub, p.CompanyID)
+	if err != nil {
+		return err
+	}
+
+	pp := purchasePrices{CompanyID: p.CompanyID, OrderID: p.OrderID}
+	for i := range p.Items {
+		pp.Items = append(pp.Items, pricedLine{
+			SpecID:    p.Items[i].SpecID,
+			How:       p.Items[i].How,
+			Money:     p.Items[i].Money,
+			BaseMoney: p.Items[i].BaseMoney,
+			Tax:       p.Items[i].Tax,
+		})
+		p.Items[i].Money = 0
+		p.Items[i].BaseMoney = 0
+		p.Items[i].Tax = 0
+	}
+	pricesJSONasBytes, err := json.Marshal(pp)
+	if err != nil {
+		return err
+	}
+	if err := putPrivateByOwner(stub, p.CompanyID, collection, key, pricesJSONasBytes); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(pricesJSONasBytes)
+	p.PriceHash = hex.EncodeToString(hash[:])
+	p.PriceCollection = collection
+	return nil
+}
+
+// revealPrices puts the money back on a purchase read from public state.
+// It returns false when the peer's organisation does not hold the prices.
+func revealPrices(stub shim.ChaincodeStubInterface, key string, p *purchase) (bool, error) {
+	if p.PriceCollection == "" {
+		// purchases from before private prices carry their money publicly
+		return true, nil
+	}
+	pricesAsBytes, err := stub.GetPrivateData(p.PriceCollection, key)
+	if err != nil || pricesAsBytes == nil {
+		return false, nil
+	}
+
+	hash := sha256.Sum256(pricesAsBytes)
+	if hex.EncodeToString(hash[:]) != p.PriceHash {
+		return false, fmt.Errorf("The prices of %s do not match their hash", key)
+	}
+	var pp purchasePrices
+	if err := json.Unmarshal(pricesAsBytes, &pp); err != nil {
+		return false, fmt.Errorf("Failed to decode JSON of prices: %s", key)
+	}
+	if len(pp.Items) != len(p.Items) {
+		return false, fmt.Errorf("The prices of %s do not match its lines", key)
+	}
+	for i := range p.Items {
+		p.Items[i].Money = pp.Items[i].Money
+		p.Items[i].BaseMoney = pp.Items[i].BaseMoney
+		p.Items[i].Tax = pp.Items[i].Tax
+	}
+	return true, nil
+}
+
+// movePrices moves a private key of a company from the collection of its
+// old owner to that of its new owner, mspID, under the new owner's
+// endorsement. The bytes, and so their hash, are unchanged.
+func movePrices(stub shim.ChaincodeStubInterface, from string, to string, key string, mspID string) error {
+	pricesAsBytes, err := stub.GetPrivateData(from, key)
+	if err != nil {
+		return err
+	} else if pricesAsBytes == nil {
+		return fmt.Errorf("The prices of %s are not held by this peer", key)
+	}
+	if err := stub.DelPrivateData(from, key); err != nil {
+		return err
+	}
+	if err := stub.PutPrivateData(to, key, pricesAsBytes); err != nil {
+		return err
+	}
+	return endorsePrivateBy(stub, to, key, mspID)
+}
+
+// moveRevisionPrices moves the prices of the revisions of a purchase into
+// the collection of the company's new owner.
+func moveRevisionPrices(stub shim.ChaincodeStubInterface, key string, collection string, mspID string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("revision", []string{key})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		var rev revision
+		if err := json.Unmarshal(response.Value, &rev); err != nil {
+			return errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		if rev.PriceCollection == "" || rev.PriceCollection == collection {
+			continue
+		}
+		if err := movePrices(stub, rev.PriceCollection, collection, response.Key, mspID); err != nil {
+			return err
+		}
+		rev.PriceCollection = collection
+		revJSONasBytes, err := json.Marshal(rev)
+		if err != nil {
+			return err
+		}
+		if err := stub.PutState(response.Key, revJSONasBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveTaxEntries moves the tax entries of a company from the collection of
+// its old owner to that of its new owner.
+func moveTaxEntries(stub shim.ChaincodeStubInterface, companyID string, from string, to string, mspID string) error {
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey(from, "tax", []string{companyID})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if err := stub.DelPrivateData(from, response.Key); err != nil {
+			return err
+		}
+		if err := stub.PutPrivateData(to, response.Key, response.Value); err != nil {
+			return err
+		}
+		if err := endorsePrivateBy(stub, to, response.Key, mspID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,30 +3,142 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
-	"github.com/hyperledger/fabric/tree/release-1.1/core/chaincode/shim"
-	pb "github.com/hyperledger/fabric/tree/release-1.1/protos/peer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Names of the other chaincodes, installed on the same channel. Purchases
+// are received into the store's stock, may only reference specs registered
+// in the spec chaincode, are bought from a supplier of the party chaincode,
+// are taxed at the rates of the tax chaincode and may not be booked into a
+// period closed in the period chaincode.
+const (
+	storeChaincode  = "store"
+	specChaincode   = "spec"
+	partyChaincode  = "party"
+	taxChaincode    = "tax"
+	periodChaincode = "period"
 )
 
 type PurchaseChaincode struct {
+	contractapi.Contract
 }
 
+// subPurchase is one ordered line. Money is in the line's currency, which
+// defaults to the purchase's, and BaseMoney the same in base currency.
+// Received defaults to the ordered quantity when the goods arrived in full.
+// DotWeek is the production week (WWYY) of the lot; Serials, when given, are
+// the DOT serials of the received tyres. Tax is the input tax on BaseMoney at
+// the rate of TaxCode.
 type subPurchase struct {
-	SpecID int     `json:"spec_id"`
-	How    int     `json:"how"`
-	Money  float64 `json:"money"`
+	SpecID    int      `json:"spec_id"`
+	How       int      `json:"how"`
+	Money     float64  `json:"money,omitempty" metadata:",optional"`
+	Currency  string   `json:"currency,omitempty" metadata:",optional"`
+	BaseMoney float64  `json:"base_money,omitempty" metadata:",optional"`
+	TaxCode   string   `json:"tax_code,omitempty" metadata:",optional"`
+	TaxRate   float64  `json:"tax_rate,omitempty" metadata:",optional"`
+	Tax       float64  `json:"tax,omitempty" metadata:",optional"`
+	Received  int      `json:"received" metadata:",optional"`
+	DotWeek   string   `json:"dot_week,omitempty" metadata:",optional"`
+	Serials   []string `json:"serials,omitempty" metadata:",optional"`
+}
+
+// UnmarshalJSON defaults received to how, so a line without it arrived in
+// full while an explicit 0 did not arrive at all.
+func (l *subPurchase) UnmarshalJSON(data []byte) error {
+	type line subPurchase
+	in := struct {
+		*line
+		Received *int `json:"received"`
+	}{line: (*line)(l)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	l.Received = l.How
+	if in.Received != nil {
+		l.Received = *in.Received
+	}
+	return nil
 }
 
+// order_id is left out when the company's sequence allocates it. Invoiced
+// is the quantity invoiced so far by spec_id.
 type purchase struct {
-	CompanyID *string       `json:"company_id"`
-	OrderID   *int          `json:"order_id"`
+	SchemaVersion int            `json:"schema_version" metadata:",optional"`
+	CompanyID     string         `json:"company_id"`
+	OrderID       int            `json:"order_id" metadata:",optional"`
+	TabNo         string         `json:"tabno" metadata:",optional"`
+	RequestID     string         `json:"request_id,omitempty" metadata:",optional"`
+	Client        string         `json:"client"`
+	AccTime       int64          `json:"acc_time"`
+	Location      string         `json:"location,omitempty" metadata:",optional"`
+	Currency      string         `json:"currency,omitempty" metadata:",optional"`
+	Items         []subPurchase  `json:"items"`
+	Invoiced      map[string]int `json:"invoiced,omitempty" metadata:",optional"`
+	Revision      int            `json:"revision" metadata:",optional"`
+
+	// purchases above the company's approval thresholds wait in pending
+	// until every required role has approved them
+	Status        string         `json:"status,omitempty" metadata:",optional"`
+	RequiredRoles []string       `json:"required_roles,omitempty" metadata:",optional"`
+	Approvals     []approvalStep `json:"approvals,omitempty" metadata:",optional"`
+
+	// the money of the lines is kept in this private data collection
+	PriceCollection string `json:"price_collection,omitempty" metadata:",optional"`
+	PriceHash       string `json:"price_hash,omitempty" metadata:",optional"`
+}
+
+// receiptLine and receipt are what the store's receive and adjust take.
+type receiptLine struct {
+	SpecID  int      `json:"spec_id"`
+	How     int      `json:"how"`
+	Money   float64  `json:"money"`
+	DotWeek string   `json:"dot_week,omitempty"`
+	Serials []string `json:"serials,omitempty"`
+}
+
+type receipt struct {
+	CompanyID string        `json:"company_id"`
+	OrderID   int           `json:"order_id"`
 	TabNo     string        `json:"tabno"`
 	Client    string        `json:"client"`
 	AccTime   int64         `json:"acc_time"`
-	Items     []subPurchase `json:"items"`
+	Location  string        `json:"location,omitempty"`
+	Items     []receiptLine `json:"items"`
+}
+
+// receipt is the purchase as it arrived: the received quantity of each line
+// at the ordered unit price, leaving out lines where nothing arrived.
+func (p *purchase) receipt() receipt {
+	r := receipt{
+		CompanyID: p.CompanyID,
+		OrderID:   p.OrderID,
+		TabNo:     p.TabNo,
+		Client:    p.Client,
+		AccTime:   p.AccTime,
+		Location:  p.Location,
+		Items:     []receiptLine{},
+	}
+	for _, l := range p.Items {
+		how := l.Received
+		if how <= 0 {
+			continue
+		}
+		r.Items = append(r.Items, receiptLine{
+			SpecID:  l.SpecID,
+			How:     how,
+			Money:   round2(l.BaseMoney / float64(l.How) * float64(how)),
+			DotWeek: l.DotWeek,
+			Serials: l.Serials,
+		})
+	}
+	return r
 }
 
 // type index struct {
@@ -38,148 +150,289 @@ type purchase struct {
 // Main
 // ===================================================================================
 func main() {
-	err := shim.Start(new(PurchaseChaincode))
+	chaincode, err := contractapi.NewChaincode(newPurchaseChaincode())
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
+		fmt.Printf("Error creating purchase chaincode: %s", err)
+		return
+	}
+	if err := chaincode.Start(); err != nil {
+		fmt.Printf("Error starting purchase chaincode: %s", err)
 	}
 }
 
-// ========================================
-// Init initializes chaincode
-// ===========================
-func (t *PurchaseChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	return shim.Success(nil)
+func newPurchaseChaincode() *PurchaseChaincode {
+	t := new(PurchaseChaincode)
+	t.Name = "purchase"
+	t.Info.Description = "Purchase orders, supplier invoices and their approvals"
+	t.BeforeTransaction = checkEnabled
+	return t
+}
+
+// GetEvaluateTransactions marks the transactions that only read the ledger,
+// so clients query rather than submit them.
+func (t *PurchaseChaincode) GetEvaluateTransactions() []string {
+	return []string{
+		"Query", "Documents", "VerifyDocument", "QueryInvoice", "QueryRate",
+		"QueryApprovalPolicy", "Revisions", "QueryByTabNo", "QuerySequence",
+		"TaxEntries", "QueryConfig", "RichQuery",
+	}
 }
 
 // ========================================
-// Invoke - Our entry point for Invocations
+// Init initializes chaincode
 // ========================================
-func (t *PurchaseChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
-	function, args := stub.GetFunctionAndParameters()
-	fmt.Println("invoke is running " + function)
-
-	// Handle different functions
-	if function == "create" { //create a new item
-		return t.create(stub, args)
-	} else if function == "query" {
-		return t.query(stub, args)
+// Instantiate may call init with the first configuration, as an admin.
+// Without a function the contract API succeeds and the stored settings are
+// kept. As init stays callable afterwards, it refuses to replace a
+// configuration; setConfig changes it.
+func (t *PurchaseChaincode) Init(ctx contractapi.TransactionContextInterface, c config) error {
+	stub := ctx.GetStub()
+	configAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return err
 	}
-
-	fmt.Println("invoke did not find func: " + function) //error
-	return shim.Error("Received unknown function invocation")
+	if configAsBytes != nil {
+		return errors.New("The configuration is already set, use setConfig to change it")
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, adminRole); err != nil {
+		return errors.New("Only an " + adminRole + " may set the configuration")
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	return putConfig(stub, &c)
 }
 
 // ============================================================
 // create - create a new item, store into chaincode state
 // ============================================================
-func (t *PurchaseChaincode) create(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *PurchaseChaincode) Create(ctx contractapi.TransactionContextInterface, p purchase) (*assigned, error) {
+	stub := ctx.GetStub()
 	var err error
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
-	}
-
 	// ==== Input sanitation ====
 	fmt.Println("- start create item")
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+	if p.CompanyID == "" {
+		return nil, errors.New("company_id must be required")
 	}
-
-	var p purchase
-	itemJSONasBytes := []byte(args[0])
-	if err := json.Unmarshal(itemJSONasBytes, &p); err != nil {
-		msg := fmt.Sprintf("-> Invalid json format - %s", args[0])
-		return shim.Error(msg)
+	if err := checkCompany(stub, p.CompanyID); err != nil {
+		return nil, err
+	}
+	// ==== A retried request returns its original result ====
+	var hash string
+	if p.RequestID != "" {
+		hash, err = payloadHash(stub)
+		if err != nil {
+			return nil, err
+		}
+		result, err := replayRequest(stub, p.CompanyID, p.RequestID, hash)
+		if err != nil {
+			return nil, err
+		}
+		if result != nil {
+			fmt.Println("- replay create item " + p.RequestID)
+			return result, nil
+		}
+	}
+	tabNo, err := nextNumber(stub, p.CompanyID, "purchase", p.AccTime, "order_id", &p.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	if tabNo != "" {
+		p.TabNo = tabNo
+	}
+	specIDs := []string{}
+	for _, line := range p.Items {
+		if line.How <= 0 {
+			return nil, fmt.Errorf("how of spec_id %d must be positive", line.SpecID)
+		}
+		if line.Received < 0 || line.Received > line.How {
+			return nil, fmt.Errorf("received of spec_id %d must be between 0 and %d", line.SpecID, line.How)
+		}
+		specIDs = append(specIDs, strconv.Itoa(line.SpecID))
+	}
+	if err := checkPeriod(stub, p.CompanyID, p.AccTime); err != nil {
+		return nil, err
+	}
+	p.SchemaVersion = schemaVersion
+	p.Invoiced = nil
+	p.Revision = 0
+	p.Approvals = nil
+	p.PriceCollection = ""
+	p.PriceHash = ""
+	if err := readTransientPrices(stub, &p); err != nil {
+		return nil, err
+	}
+	if err := convertCurrency(stub, &p); err != nil {
+		return nil, err
+	}
+	entry, err := computeTax(stub, &p)
+	if err != nil {
+		return nil, err
 	}
-	if p.CompanyID == nil {
-		return shim.Error("company_id must be required")
+	if err := checkSpecs(stub, specIDs); err != nil {
+		return nil, err
 	}
-	if p.OrderID == nil {
-		return shim.Error("order_id must be required")
+	if err := checkParty(stub, p.Client, "supplier"); err != nil {
+		return nil, err
 	}
-	// key := fmt.Sprintf("%s-%s", strconv.Itoa(*p.CompanyID), strconv.Itoa(*p.OrderID))
-	key := fmt.Sprintf("%s-%s", *p.CompanyID, strconv.Itoa(*p.OrderID))
+	// key := fmt.Sprintf("%s-%s", strconv.Itoa(p.CompanyID), strconv.Itoa(p.OrderID))
+	key := fmt.Sprintf("%s-%s", p.CompanyID, strconv.Itoa(p.OrderID))
 
 	fmt.Printf("key %s\n", key)
 
 	// ==== Check if item already exists ====
 	itemAsBytes, err := stub.GetState(key)
 	if err != nil {
-		return shim.Error("Failed to get item: " + err.Error())
+		return nil, errors.New("Failed to get item: " + err.Error())
 	} else if itemAsBytes != nil {
 		msg := fmt.Sprintf("The key %s has already existed!", key)
-		return shim.Error(msg)
+		return nil, errors.New(msg)
+	}
+	if err := indexTabNo(stub, p.CompanyID, p.TabNo, strconv.Itoa(p.OrderID)); err != nil {
+		return nil, err
+	}
+
+	// ==== Large purchases wait for approval before stock is received ====
+	p.RequiredRoles, err = requiredRoles(stub, p.CompanyID, p.amount())
+	if err != nil {
+		return nil, err
+	}
+	p.Status = approvalApproved
+	if len(p.RequiredRoles) > 0 {
+		p.Status = approvalPending
+	} else {
+		// ==== Receive the lines into stock ====
+		receiptJSONasBytes, err := json.Marshal(p.receipt())
+		if err != nil {
+			return nil, err
+		}
+		response := stub.InvokeChaincode(storeChaincode, [][]byte{[]byte("receive"), receiptJSONasBytes}, "")
+		if response.Status != shim.OK {
+			return nil, errors.New("Failed to receive into store: " + response.Message)
+		}
+		if err := putTaxEntry(stub, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	// ==== Keep the prices private to the company's owner ====
+	if err := hidePrices(stub, key, &p); err != nil {
+		return nil, err
+	}
+
+	itemJSONasBytes, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
 	}
 
 	// === Save item to state ===
 	err = stub.PutState(key, itemJSONasBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
+	}
+	if err := endorseByOwner(stub, p.CompanyID, key); err != nil {
+		return nil, err
 	}
 
-	// ==== Item saved and indexed. Return success ====
+	// ==== Item saved and indexed. Return the assigned key ====
+	result := assigned{Key: key, OrderID: p.OrderID, TabNo: p.TabNo, Status: p.Status}
+	if p.RequestID != "" {
+		if err := recordRequest(stub, p.CompanyID, p.RequestID, hash, &result); err != nil {
+			return nil, err
+		}
+	}
 	fmt.Println("- end create item")
-	return shim.Success(nil)
+	return &result, nil
+}
+
+// checkSpecs fails unless every spec_id is registered in the spec chaincode
+// and has not been discontinued.
+func checkSpecs(stub shim.ChaincodeStubInterface, specIDs []string) error {
+	specIDsAsBytes, err := json.Marshal(specIDs)
+	if err != nil {
+		return err
+	}
+	args := [][]byte{[]byte("check"), specIDsAsBytes}
+	response := stub.InvokeChaincode(specChaincode, args, "")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// checkParty fails unless client is an active party of the party chaincode
+// that may act in role.
+func checkParty(stub shim.ChaincodeStubInterface, client string, role string) error {
+	args := [][]byte{[]byte("check"), []byte(client), []byte(role)}
+	response := stub.InvokeChaincode(partyChaincode, args, "")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// checkPeriod fails if accTime falls in a period of the company that the
+// period chaincode has closed.
+func checkPeriod(stub shim.ChaincodeStubInterface, companyID string, accTime int64) error {
+	args := [][]byte{[]byte("check"), []byte(companyID), []byte(strconv.FormatInt(accTime, 10))}
+	response := stub.InvokeChaincode(periodChaincode, args, "")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
 }
 
 // ==================================================
 // delete - remove a item from state
 // ==================================================
-func (t *PurchaseChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *PurchaseChaincode) delete(ctx contractapi.TransactionContextInterface, companyID string, id string) error {
+	stub := ctx.GetStub()
 	var jsonResp string
 	var itemJSON purchase
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
-	}
-
 	// ==== Input sanitation ====
 	fmt.Println("- start delete item")
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+	if len(companyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
 	}
 
-	companyID := args[0]
-	id := args[1]
 	key := fmt.Sprintf("%s-%s", companyID, id)
 
 	itemAsbytes, err := stub.GetState(key) //get the item from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return errors.New(jsonResp)
 	} else if itemAsbytes == nil {
 		jsonResp = "{\"Error\":\"Item does not exist: " + key + "\"}"
-		return shim.Error(jsonResp)
+		return errors.New(jsonResp)
 	}
 
 	err = json.Unmarshal([]byte(itemAsbytes), &itemJSON)
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to decode JSON of: " + key + "\"}"
-		return shim.Error(jsonResp)
+		return errors.New(jsonResp)
 	}
 
 	err = stub.DelState(key) //remove the item from chaincode state
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return errors.New("Failed to delete state:" + err.Error())
 	}
 
 	fmt.Println("- end delete item")
-	return shim.Success(nil)
+	return nil
 }
 
 // ==================================================
 // query - query a item by ID
 // ==================================================
-func (t *PurchaseChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *PurchaseChaincode) Query(ctx contractapi.TransactionContextInterface, key string) (*purchase, error) {
+	stub := ctx.GetStub()
 
 	fmt.Println("- start query item")
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
-	}
-
 	// ==== Input sanitation ====
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+	if len(key) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
 	}
 
 	// var idx index
@@ -189,42 +442,43 @@ func (t *PurchaseChaincode) query(stub shim.ChaincodeStubInterface, args []strin
 	// 	return shim.Error(msg)
 	// }
 	// key := fmt.Sprintf("%s-%s", idx.CompanyID, strconv.Itoa(idx.OrderID))
-	key := args[0]
 
 	// Get the state from the ledger
 	itemAsbytes, err := stub.GetState(key)
 	if err != nil {
 		jsonResp := "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return nil, errors.New(jsonResp)
 	}
 
 	if itemAsbytes == nil {
 		jsonResp := "{\"Error\":\"Nil selling for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return nil, errors.New(jsonResp)
 	}
 
-	fmt.Printf("Query Response:%s\n", string(itemAsbytes[:]))
+	// ==== Show the prices to members of the company's owner ====
+	var p purchase
+	if err := decodePurchase(itemAsbytes, &p); err != nil {
+		return nil, errors.New("Failed to decode JSON of: " + key)
+	}
+	if _, err := revealPrices(stub, key, &p); err != nil {
+		return nil, err
+	}
 
 	fmt.Println("- end query item")
-	return shim.Success(itemAsbytes)
+	return &p, nil
 }
 
-func (t *PurchaseChaincode) getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *PurchaseChaincode) getHistory(ctx contractapi.TransactionContextInterface, companyID string, id string) (string, error) {
+	stub := ctx.GetStub()
 	fmt.Println("- start getHistory item")
 
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-
-	companyID := args[0]
-	id := args[1]
 	key := fmt.Sprintf("%s-%s", companyID, id)
 
 	fmt.Printf("- start getHistory: %s\n", key)
 
 	resultsIterator, err := stub.GetHistoryForKey(key)
 	if err != nil {
-		return shim.Error(err.Error())
+		return "", err
 	}
 	defer resultsIterator.Close()
 
@@ -236,7 +490,7 @@ func (t *PurchaseChaincode) getHistory(stub shim.ChaincodeStubInterface, args []
 	for resultsIterator.HasNext() {
 		response, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return "", err
 		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
@@ -275,5 +529,5 @@ func (t *PurchaseChaincode) getHistory(stub shim.ChaincodeStubInterface, args []
 	fmt.Printf("- getHistoryForPurchase returning:\n%s\n", buffer.String())
 
 	fmt.Println("- end getHistory item")
-	return shim.Success(buffer.Bytes())
+	return string(buffer.Bytes()), nil
 }
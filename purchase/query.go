@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxPageSize caps the purchases returned by one richQuery page.
+const maxPageSize = 200
+
+// queryFields are the fields of a purchase a richQuery selector may use.
+// The money of the lines is kept private and cannot be selected on.
+var queryFields = map[string]bool{
+	"company_id":     true,
+	"order_id":       true,
+	"tabno":          true,
+	"client":         true,
+	"acc_time":       true,
+	"location":       true,
+	"currency":       true,
+	"status":         true,
+	"revision":       true,
+	"items.spec_id":  true,
+	"items.how":      true,
+	"items.received": true,
+	"items.currency": true,
+	"items.tax_code": true,
+	"items.dot_week": true,
+}
+
+// queryLists are the array fields whose elements $elemMatch and $allMatch
+// select on.
+var queryLists = map[string]bool{
+	"items": true,
+}
+
+// fieldOperators are the Mango operators comparing the value of a field.
+var fieldOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true,
+	"$in": true, "$nin": true, "$exists": true, "$all": true, "$size": true,
+}
+
+// queryRecord is one purchase found by richQuery.
+type queryRecord struct {
+	Key    string   `json:"key"`
+	Record purchase `json:"record"`
+}
+
+// queryPage is one page of richQuery results. Fetched counts the records
+// CouchDB read for the page; a page with fewer than pageSize is the last.
+type queryPage struct {
+	Records  []queryRecord `json:"records"`
+	Fetched  int32         `json:"fetched"`
+	Bookmark string        `json:"bookmark"`
+}
+
+// checkField rejects a field outside queryFields, and a field of the
+// elements of a list outside $elemMatch / $allMatch: Mango does not look
+// into arrays for a bare "items.spec_id", so it would silently match nothing.
+func checkField(path string, element bool) error {
+	if !queryFields[path] {
+		return fmt.Errorf("Field %s may not be queried", path)
+	}
+	if list := strings.SplitN(path, ".", 2)[0]; queryLists[list] && !element {
+		return fmt.Errorf("Field %s must be selected with $elemMatch or $allMatch on %s", path, list)
+	}
+	return nil
+}
+
+// checkSelector rejects selectors on fields outside queryFields and
+// operators other than the comparisons and combinations of fields. field is
+// the path the selector applies to, "" at the top; element is true inside
+// $elemMatch and $allMatch.
+func checkSelector(selector map[string]interface{}, field string, element bool) error {
+	for name, value := range selector {
+		switch {
+		case name == "$and" || name == "$or" || name == "$nor":
+			selectors, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s takes a list of selectors", name)
+			}
+			for _, s := range selectors {
+				sub, ok := s.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s takes a list of selectors", name)
+				}
+				if err := checkSelector(sub, field, element); err != nil {
+					return err
+				}
+			}
+		case name == "$not" || name == "$elemMatch" || name == "$allMatch":
+			if name != "$not" && !queryLists[field] {
+				return fmt.Errorf("%s must be applied to items", name)
+			}
+			sub, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s takes a selector", name)
+			}
+			if err := checkSelector(sub, field, element || name != "$not"); err != nil {
+				return err
+			}
+		case fieldOperators[name]:
+			if field == "" {
+				return fmt.Errorf("%s must be applied to a field", name)
+			}
+			if err := checkField(field, element); err != nil {
+				return err
+			}
+		case strings.HasPrefix(name, "$"):
+			return fmt.Errorf("Operator %s may not be used", name)
+		default:
+			path := name
+			if field != "" {
+				path = field + "." + name
+			}
+			if sub, ok := value.(map[string]interface{}); ok {
+				if err := checkSelector(sub, path, element); err != nil {
+					return err
+				}
+			} else if err := checkField(path, element); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// richQuery - find purchases with a CouchDB selector on the fields of
+// queryFields, pageSize at a time. Pass the returned bookmark to the next
+// call for the following page. Only for queries: the peer does not
+// re-execute selectors at commit, so results may be stale in a submitted
+// transaction.
+// args: selector, pageSize, bookmark ("" to start)
+// ============================================================
+func (t *PurchaseChaincode) RichQuery(ctx contractapi.TransactionContextInterface, selectorJSON string, pageSize int, bookmark string) (*queryPage, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start richQuery")
+	if pageSize <= 0 || pageSize > maxPageSize {
+		return nil, fmt.Errorf("pageSize must be between 1 and %d", maxPageSize)
+	}
+
+	// ==== Pass numbers on as written rather than as floats ====
+	var selector map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(selectorJSON)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&selector); err != nil || selector == nil {
+		return nil, fmt.Errorf("Invalid json format - %s", selectorJSON)
+	}
+	if err := checkSelector(selector, "", false); err != nil {
+		return nil, err
+	}
+	queryAsBytes, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, metadata, err := stub.GetQueryResultWithPagination(string(queryAsBytes), int32(pageSize), bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	page := queryPage{Records: []queryRecord{}, Fetched: metadata.FetchedRecordsCount, Bookmark: metadata.Bookmark}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		// revisions, invoices and the other records share the namespace
+		if !isDocumentKey(response.Key) {
+			continue
+		}
+		var p purchase
+		if err := decodePurchase(response.Value, &p); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		if _, err := revealPrices(stub, response.Key, &p); err != nil {
+			return nil, err
+		}
+		page.Records = append(page.Records, queryRecord{Key: response.Key, Record: p})
+	}
+
+	fmt.Println("- end richQuery")
+	return &page, nil
+}
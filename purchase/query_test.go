@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		wantErr  bool
+	}{
+		{name: "top field", selector: `{"company_id":"3","acc_time":{"$gte":1,"$lt":2}}`},
+		{name: "list field in $elemMatch", selector: `{"items":{"$elemMatch":{"spec_id":1111,"how":{"$gt":2}}}}`},
+		{name: "list field in $allMatch", selector: `{"items":{"$allMatch":{"spec_id":{"$in":[1111,2222]}}}}`},
+		{name: "$elemMatch under $not", selector: `{"items":{"$not":{"$elemMatch":{"spec_id":1111}}}}`},
+		{name: "$or of $elemMatch", selector: `{"$or":[{"items":{"$elemMatch":{"spec_id":1111}}},{"client":"Org2"}]}`},
+		{name: "bare list field", selector: `{"items.spec_id":1111}`, wantErr: true},
+		{name: "bare list field in $or", selector: `{"$or":[{"items.spec_id":1111},{"client":"Org2"}]}`, wantErr: true},
+		{name: "$elemMatch on a plain field", selector: `{"client":{"$elemMatch":{"$eq":"Org2"}}}`, wantErr: true},
+		{name: "unknown field", selector: `{"secret":1}`, wantErr: true},
+		{name: "unknown field in $elemMatch", selector: `{"items":{"$elemMatch":{"secret":1}}}`, wantErr: true},
+		{name: "operator at the top", selector: `{"$gt":1}`, wantErr: true},
+		{name: "$regex", selector: `{"client":{"$regex":"^Org"}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var selector map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.selector), &selector); err != nil {
+				t.Fatal(err)
+			}
+			err := checkSelector(selector, "", false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
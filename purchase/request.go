@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// clientRequest remembers the create a client request_id led to, so a retry
+// of the same request returns the original result instead of failing or
+// creating a duplicate.
+type clientRequest struct {
+	CompanyID   string          `json:"company_id"`
+	RequestID   string          `json:"request_id"`
+	Key         string          `json:"key"`
+	PayloadHash string          `json:"payload_hash"`
+	Result      json.RawMessage `json:"result"`
+}
+
+func requestKey(stub shim.ChaincodeStubInterface, companyID string, requestID string) (string, error) {
+	return stub.CreateCompositeKey("request", []string{companyID, requestID})
+}
+
+// payloadHash is the SHA-256 of the arguments of create, as sent, and of the
+// transient prices, which are part of the request but not of its arguments.
+func payloadHash(stub shim.ChaincodeStubInterface) (string, error) {
+	_, args := stub.GetFunctionAndParameters()
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, arg := range args {
+		h.Write([]byte(arg))
+		h.Write([]byte{0})
+	}
+	h.Write(transient[pricesTransientKey])
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// replayRequest returns the result of an earlier create with the same
+// request_id, or nil if there was none. A request_id reused for a different
+// payload is a conflict.
+func replayRequest(stub shim.ChaincodeStubInterface, companyID string, requestID string, hash string) (*assigned, error) {
+	key, err := requestKey(stub, companyID, requestID)
+	if err != nil {
+		return nil, err
+	}
+	requestAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if requestAsBytes == nil {
+		return nil, nil
+	}
+	var r clientRequest
+	if err := json.Unmarshal(requestAsBytes, &r); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", key)
+	}
+	if r.PayloadHash != hash {
+		return nil, fmt.Errorf("Conflict: request_id %s was used for %s with a different payload", requestID, r.Key)
+	}
+	var result assigned
+	if err := json.Unmarshal(r.Result, &result); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", key)
+	}
+	return &result, nil
+}
+
+func recordRequest(stub shim.ChaincodeStubInterface, companyID string, requestID string, hash string, result *assigned) error {
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	r := clientRequest{
+		CompanyID:   companyID,
+		RequestID:   requestID,
+		Key:         result.Key,
+		PayloadHash: hash,
+		Result:      resultAsBytes,
+	}
+	rKey, err := requestKey(stub, companyID, requestID)
+	if err != nil {
+		return err
+	}
+	requestJSONasBytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return putByOwner(stub, companyID, rKey, requestJSONasBytes)
+}
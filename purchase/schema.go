@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// schemaVersion is the shape of the purchases this chaincode writes. Version
+// 1 is everything written before purchases carried a version: company_id may
+// be a number, order_id a string, and lines may have price instead of money.
+const schemaVersion = 2
+
+// migration is the result of one migrate batch. Bookmark is where the next
+// batch starts; it is empty when done.
+type migration struct {
+	Scanned  int    `json:"scanned"`
+	Migrated int    `json:"migrated"`
+	Bookmark string `json:"bookmark"`
+	Done     bool   `json:"done"`
+}
+
+// upgradeV1 rewrites a version 1 purchase, decoded into a map, to version 2.
+func upgradeV1(doc map[string]interface{}) {
+	if companyID, ok := doc["company_id"].(float64); ok {
+		doc["company_id"] = strconv.FormatFloat(companyID, 'f', -1, 64)
+	}
+	if orderID, ok := doc["order_id"].(string); ok {
+		if n, err := strconv.Atoi(orderID); err == nil {
+			doc["order_id"] = n
+		}
+	}
+	items, _ := doc["items"].([]interface{})
+	for _, it := range items {
+		line, ok := it.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		price, hasPrice := line["price"].(float64)
+		how, _ := line["how"].(float64)
+		if _, hasMoney := line["money"]; !hasMoney && hasPrice {
+			line["money"] = price * how
+		}
+		delete(line, "price")
+	}
+}
+
+// decodePurchase unmarshals a stored purchase of any schema version.
+func decodePurchase(docAsBytes []byte, p *purchase) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(docAsBytes, &doc); err != nil {
+		return err
+	}
+	version, _ := doc["schema_version"].(float64)
+	if int(version) < 2 {
+		upgradeV1(doc)
+	}
+	doc["schema_version"] = schemaVersion
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(upgraded, p)
+}
+
+// isDocumentKey tells the "<company_id>-<order_id>" keys of purchases from
+// the other simple keys of the namespace.
+func isDocumentKey(key string) bool {
+	n := strings.LastIndex(key, "-")
+	if n <= 0 {
+		return false
+	}
+	_, err := strconv.Atoi(key[n+1:])
+	return err == nil
+}
+
+// ============================================================
+// migrate - rewrite purchases of older schema versions in the current one,
+// batchSize keys at a time. Pass the returned bookmark to the next call
+// until done.
+// args: batchSize, bookmark ("" to start)
+// ============================================================
+func (t *PurchaseChaincode) Migrate(ctx contractapi.TransactionContextInterface, batchSize int, bookmark string) (*migration, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start migrate")
+	if batchSize <= 0 {
+		return nil, errors.New("batchSize must be positive")
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, adminRole); err != nil {
+		return nil, errors.New("Only an " + adminRole + " may migrate")
+	}
+
+	resultsIterator, err := stub.GetStateByRange(bookmark, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	m := migration{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if m.Scanned == batchSize {
+			m.Bookmark = response.Key
+			break
+		}
+		m.Scanned++
+		if !isDocumentKey(response.Key) {
+			continue
+		}
+
+		var version struct {
+			SchemaVersion int `json:"schema_version"`
+		}
+		if err := json.Unmarshal(response.Value, &version); err == nil && version.SchemaVersion >= schemaVersion {
+			continue
+		}
+		var p purchase
+		if err := decodePurchase(response.Value, &p); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		itemJSONasBytes, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := stub.PutState(response.Key, itemJSONasBytes); err != nil {
+			return nil, err
+		}
+		m.Migrated++
+	}
+	m.Done = m.Bookmark == ""
+
+	fmt.Println("- end migrate")
+	return &m, nil
+}
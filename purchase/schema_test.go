@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodePurchase(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    purchase
+		wantErr bool
+	}{
+		{
+			name: "version 1 with price",
+			doc:  `{"company_id":3,"order_id":"10","client":"Org2","acc_time":1,"items":[{"spec_id":1111,"how":4,"price":25}]}`,
+			want: purchase{SchemaVersion: 2, CompanyID: "3", OrderID: 10, Client: "Org2", AccTime: 1,
+				Items: []subPurchase{{SpecID: 1111, How: 4, Money: 100, Received: 4}}},
+		},
+		{
+			name: "version 1 with money",
+			doc:  `{"company_id":"3","order_id":10,"client":"Org2","acc_time":1,"items":[{"spec_id":1111,"how":4,"money":90,"price":25}]}`,
+			want: purchase{SchemaVersion: 2, CompanyID: "3", OrderID: 10, Client: "Org2", AccTime: 1,
+				Items: []subPurchase{{SpecID: 1111, How: 4, Money: 90, Received: 4}}},
+		},
+		{
+			name: "version 2",
+			doc:  `{"schema_version":2,"company_id":"3","order_id":10,"client":"Org2","acc_time":1,"items":[{"spec_id":1111,"how":4,"received":2}],"price_collection":"Org1MSPPrices"}`,
+			want: purchase{SchemaVersion: 2, CompanyID: "3", OrderID: 10, Client: "Org2", AccTime: 1,
+				Items: []subPurchase{{SpecID: 1111, How: 4, Received: 2}}, PriceCollection: "Org1MSPPrices"},
+		},
+		{
+			name:    "order_id not a number",
+			doc:     `{"company_id":3,"order_id":"A10","client":"Org2","acc_time":1,"items":[]}`,
+			wantErr: true,
+		},
+		{
+			name:    "not JSON",
+			doc:     `3-10`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p purchase
+			err := decodePurchase([]byte(tt.doc), &p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(p, tt.want) {
+				t.Errorf("got %+v, want %+v", p, tt.want)
+			}
+		})
+	}
+}
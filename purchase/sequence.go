@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// sequenceTypes are the documents that can be numbered by a sequence.
+var sequenceTypes = map[string]bool{
+	"purchase": true,
+}
+
+// counterToken is the {NNNNNN} of a sequence format, zero padded to the
+// number of Ns.
+var counterToken = regexp.MustCompile(`\{N+\}`)
+
+// sequence numbers the documents of one type of a company. Once a company
+// has a sequence, create allocates order_id from Next and tabno from Format,
+// e.g. "P-{YYYY}-{NNNNNN}" gives P-2026-000123; {YYYY}, {YY} and {MM} are
+// taken from acc_time. A failed create does not commit the increment, so
+// the numbers have no gaps.
+type sequence struct {
+	CompanyID string `json:"company_id"`
+	DocType   string `json:"doc_type"`
+	Format    string `json:"format"`
+	Next      int    `json:"next"`
+}
+
+// assigned is returned by create: the key of the new document, the numbers
+// it was given and whether it waits for approval.
+type assigned struct {
+	Key     string `json:"key"`
+	OrderID int    `json:"order_id"`
+	TabNo   string `json:"tabno"`
+	Status  string `json:"status"`
+}
+
+func (seq *sequence) number(n int, accTime int64) string {
+	t := time.Unix(accTime, 0).UTC()
+	no := strings.NewReplacer("{YYYY}", t.Format("2006"), "{YY}", t.Format("06"), "{MM}", t.Format("01")).Replace(seq.Format)
+	return counterToken.ReplaceAllStringFunc(no, func(token string) string {
+		return fmt.Sprintf("%0*d", len(token)-2, n)
+	})
+}
+
+func sequenceKey(stub shim.ChaincodeStubInterface, companyID string, docType string) (string, error) {
+	return stub.CreateCompositeKey("seq", []string{companyID, docType})
+}
+
+// getSequence returns nil if the company numbers these documents itself.
+func getSequence(stub shim.ChaincodeStubInterface, companyID string, docType string) (*sequence, error) {
+	key, err := sequenceKey(stub, companyID, docType)
+	if err != nil {
+		return nil, err
+	}
+	seqAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if seqAsBytes == nil {
+		return nil, nil
+	}
+	seq := &sequence{}
+	if err := json.Unmarshal(seqAsBytes, seq); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", key)
+	}
+	return seq, nil
+}
+
+func putSequence(stub shim.ChaincodeStubInterface, seq *sequence) error {
+	key, err := sequenceKey(stub, seq.CompanyID, seq.DocType)
+	if err != nil {
+		return err
+	}
+	seqJSONasBytes, err := json.Marshal(seq)
+	if err != nil {
+		return err
+	}
+	return putByOwner(stub, seq.CompanyID, key, seqJSONasBytes)
+}
+
+// nextNumber sets *id, the field of the document, from the company's
+// sequence for docType and returns the formatted number. Without a sequence
+// the caller must bring its own id and "" is returned; with one it must
+// leave it out (0).
+func nextNumber(stub shim.ChaincodeStubInterface, companyID string, docType string, accTime int64, field string, id *int) (string, error) {
+	seq, err := getSequence(stub, companyID, docType)
+	if err != nil {
+		return "", err
+	}
+	if seq == nil {
+		if *id == 0 {
+			return "", fmt.Errorf("%s must be required", field)
+		}
+		return "", nil
+	}
+	if *id != 0 {
+		return "", fmt.Errorf("%s of %s documents of company %s is allocated by its sequence", field, docType, companyID)
+	}
+	n := seq.Next
+	*id = n
+	seq.Next++
+	if err := putSequence(stub, seq); err != nil {
+		return "", err
+	}
+	return seq.number(n, accTime), nil
+}
+
+// ============================================================
+// setSequence - number the documents of a company on the ledger
+// args: company_id, doc_type, format, next (0 for the default 1, only when
+// the sequence is new)
+// ============================================================
+func (t *PurchaseChaincode) SetSequence(ctx contractapi.TransactionContextInterface, companyID string, docType string, format string, next int) error {
+	stub := ctx.GetStub()
+	fmt.Println("- start setSequence")
+	if len(companyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
+	}
+	if !sequenceTypes[docType] {
+		return errors.New("Unknown document type " + docType)
+	}
+	if len(counterToken.FindAllString(format, -1)) != 1 {
+		return errors.New("format must contain one counter such as {NNNNNN}")
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a " + managerRole + " may set a sequence")
+	}
+
+	seq, err := getSequence(stub, companyID, docType)
+	if err != nil {
+		return err
+	}
+	if seq == nil {
+		seq = &sequence{CompanyID: companyID, DocType: docType, Next: 1}
+		if next < 0 {
+			return errors.New("next must not be negative")
+		}
+		if next > 0 {
+			seq.Next = next
+		}
+	} else if next != 0 {
+		return errors.New("next can not be changed once the sequence is in use")
+	}
+	seq.Format = format
+	if err := putSequence(stub, seq); err != nil {
+		return err
+	}
+
+	fmt.Println("- end setSequence")
+	return nil
+}
+
+// ==================================================
+// querySequence - the sequence of a company and document type
+// ==================================================
+func (t *PurchaseChaincode) QuerySequence(ctx contractapi.TransactionContextInterface, companyID string, docType string) (*sequence, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start querySequence")
+	seq, err := getSequence(stub, companyID, docType)
+	if err != nil {
+		return nil, err
+	}
+	if seq == nil {
+		return nil, errors.New("No sequence for " + docType + " of company " + companyID)
+	}
+
+	fmt.Println("- end querySequence")
+	return seq, nil
+}
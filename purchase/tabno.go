@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// findTabNo returns the order_id of the document of a company with tabno,
+// or "" if there is none.
+func findTabNo(stub shim.ChaincodeStubInterface, companyID string, tabNo string) (string, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("company~tabno", []string{companyID, tabNo})
+	if err != nil {
+		return "", err
+	}
+	defer resultsIterator.Close()
+	if !resultsIterator.HasNext() {
+		return "", nil
+	}
+	response, err := resultsIterator.Next()
+	if err != nil {
+		return "", err
+	}
+	_, keyParts, err := stub.SplitCompositeKey(response.Key)
+	if err != nil {
+		return "", err
+	}
+	return keyParts[2], nil
+}
+
+// indexTabNo rejects a tabno already printed on another document of the
+// company and records it otherwise. Documents without tabno are not indexed.
+func indexTabNo(stub shim.ChaincodeStubInterface, companyID string, tabNo string, orderID string) error {
+	if tabNo == "" {
+		return nil
+	}
+	existing, err := findTabNo(stub, companyID, tabNo)
+	if err != nil {
+		return err
+	}
+	if existing != "" && existing != orderID {
+		return fmt.Errorf("The tabno %s is already used by %s-%s", tabNo, companyID, existing)
+	}
+	indexKey, err := stub.CreateCompositeKey("company~tabno", []string{companyID, tabNo, orderID})
+	if err != nil {
+		return err
+	}
+	return putByOwner(stub, companyID, indexKey, []byte{0x00})
+}
+
+// ==================================================
+// queryByTabNo - query a item by the tabno printed on its paperwork
+// ==================================================
+func (t *PurchaseChaincode) QueryByTabNo(ctx contractapi.TransactionContextInterface, companyID string, tabNo string) (*purchase, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start queryByTabNo")
+	if len(companyID) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+	if len(tabNo) <= 0 {
+		return nil, errors.New("2nd argument must be a non-empty string")
+	}
+
+	orderID, err := findTabNo(stub, companyID, tabNo)
+	if err != nil {
+		return nil, err
+	}
+	if orderID == "" {
+		jsonResp := "{\"Error\":\"No item with tabno " + tabNo + " in company " + companyID + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	fmt.Println("- end queryByTabNo")
+	return t.Query(ctx, fmt.Sprintf("%s-%s", companyID, orderID))
+}
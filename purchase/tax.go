@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// taxLine and taxEntry are the input tax of one purchase, read by the tax
+// chaincode's taxReport. Like the prices, they are kept in the private data
+// collection of the company's owner.
+type taxLine struct {
+	TaxCode string  `json:"tax_code"`
+	Rate    float64 `json:"rate"`
+	Base    float64 `json:"base"`
+	Tax     float64 `json:"tax"`
+}
+
+type taxEntry struct {
+	CompanyID string    `json:"company_id"`
+	DocType   string    `json:"doc_type"`
+	DocID     string    `json:"doc_id"`
+	AccTime   int64     `json:"acc_time"`
+	Lines     []taxLine `json:"lines"`
+}
+
+// resolveTax asks the tax chaincode for the rates of codes in effect on the
+// day of accTime.
+func resolveTax(stub shim.ChaincodeStubInterface, accTime int64, codes []string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	if len(codes) == 0 {
+		return rates, nil
+	}
+	codesAsBytes, err := json.Marshal(codes)
+	if err != nil {
+		return nil, err
+	}
+	args := [][]byte{[]byte("resolve"), []byte(rateDate(accTime)), codesAsBytes}
+	response := stub.InvokeChaincode(taxChaincode, args, "")
+	if response.Status != shim.OK {
+		return nil, errors.New(response.Message)
+	}
+	if err := json.Unmarshal(response.Payload, &rates); err != nil {
+		return nil, fmt.Errorf("Invalid rates returned by tax")
+	}
+	return rates, nil
+}
+
+// computeTax sets the input tax of each line with a tax_code from its base
+// currency money, and returns the entry for the tax report. Lines without a
+// tax_code are not taxed.
+func computeTax(stub shim.ChaincodeStubInterface, p *purchase) (*taxEntry, error) {
+	codes := []string{}
+	for _, l := range p.Items {
+		if l.TaxCode != "" {
+			codes = append(codes, l.TaxCode)
+		}
+	}
+	rates, err := resolveTax(stub, p.AccTime, codes)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &taxEntry{
+		CompanyID: p.CompanyID,
+		DocType:   "purchase",
+		DocID:     strconv.Itoa(p.OrderID),
+		AccTime:   p.AccTime,
+		Lines:     []taxLine{},
+	}
+	for i := range p.Items {
+		l := &p.Items[i]
+		l.TaxRate = 0
+		l.Tax = 0
+		if l.TaxCode == "" {
+			continue
+		}
+		l.TaxRate = rates[l.TaxCode]
+		l.Tax = round2(l.BaseMoney * l.TaxRate / 100)
+		entry.Lines = append(entry.Lines, taxLine{TaxCode: l.TaxCode, Rate: l.TaxRate, Base: l.BaseMoney, Tax: l.Tax})
+	}
+	return entry, nil
+}
+
+// putTaxEntry keeps a tax entry in the owner's private collection.
+func putTaxEntry(stub shim.ChaincodeStubInterface, entry *taxEntry) error {
+	collection, err := priceCollection(stub, entry.CompanyID)
+	if err != nil {
+		return err
+	}
+	key, err := stub.CreateCompositeKey("tax", []string{entry.CompanyID, entry.DocType, entry.DocID})
+	if err != nil {
+		return err
+	}
+	entryJSONasBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return putPrivateByOwner(stub, entry.CompanyID, collection, key, entryJSONasBytes)
+}
+
+// ==================================================
+// taxEntries - input tax entries of a company with from <= acc_time < to
+// ==================================================
+func (t *PurchaseChaincode) TaxEntries(ctx contractapi.TransactionContextInterface, companyID string, from int64, to int64) ([]taxEntry, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start taxEntries")
+
+	collection, err := priceCollection(stub, companyID)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey(collection, "tax", []string{companyID})
+	if err != nil {
+		return nil, errors.New("Failed to read tax entries of " + collection + ": " + err.Error())
+	}
+	defer resultsIterator.Close()
+
+	entries := []taxEntry{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var entry taxEntry
+		if err := json.Unmarshal(response.Value, &entry); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		if entry.AccTime >= from && entry.AccTime < to {
+			entries = append(entries, entry)
+		}
+	}
+
+	fmt.Println("- end taxEntries")
+	return entries, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// configKey is the reserved key the settings of the chaincode are kept
+// under.
+const configKey = "config"
+
+// config holds the settings that differ between branches, set by Init and
+// setConfig. An empty list of companies allows any. Features switches
+// functions off by name, e.g. {"creditNote": false}.
+type config struct {
+	Companies []string        `json:"companies"`
+	Features  map[string]bool `json:"features,omitempty" metadata:",optional"`
+}
+
+// validate refuses empty company IDs and features that name no function.
+func (c *config) validate() error {
+	for _, companyID := range c.Companies {
+		if companyID == "" {
+			return errors.New("companies must not contain an empty company_id")
+		}
+	}
+	contract := reflect.TypeOf(new(SellingChaincode))
+	for function := range c.Features {
+		if function == "" {
+			return errors.New("features must not contain an empty function name")
+		}
+		if _, ok := contract.MethodByName(strings.ToUpper(function[:1]) + function[1:]); !ok {
+			return fmt.Errorf("feature %s is not a function of the chaincode", function)
+		}
+	}
+	return nil
+}
+
+func getConfig(stub shim.ChaincodeStubInterface) (*config, error) {
+	configAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &config{Companies: []string{}}
+	if configAsBytes == nil {
+		return c, nil
+	}
+	if err := json.Unmarshal(configAsBytes, c); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", configKey)
+	}
+	if c.Companies == nil {
+		c.Companies = []string{}
+	}
+	return c, nil
+}
+
+func putConfig(stub shim.ChaincodeStubInterface, c *config) error {
+	configJSONasBytes, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(configKey, configJSONasBytes)
+}
+
+// enabled is false for functions switched off by the configuration. The
+// configuration itself can always be changed.
+func (c *config) enabled(function string) bool {
+	if function == "setConfig" || function == "queryConfig" {
+		return true
+	}
+	enabled, ok := c.Features[function]
+	return !ok || enabled
+}
+
+// checkEnabled runs before every transaction and refuses the functions the
+// configuration switched off.
+func checkEnabled(ctx contractapi.TransactionContextInterface) error {
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+	function = function[strings.LastIndex(function, ":")+1:]
+	if function == "" {
+		return nil
+	}
+	function = strings.ToLower(function[:1]) + function[1:]
+	fmt.Println("invoke is running " + function)
+
+	c, err := getConfig(ctx.GetStub())
+	if err != nil {
+		return err
+	}
+	if !c.enabled(function) {
+		return fmt.Errorf("Function %s is disabled by the configuration", function)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCompany fails for a company the configuration does not know.
+func checkCompany(stub shim.ChaincodeStubInterface, companyID string) error {
+	c, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+	if len(c.Companies) > 0 && !contains(c.Companies, companyID) {
+		return fmt.Errorf("company_id %s is not configured", companyID)
+	}
+	return nil
+}
+
+// ============================================================
+// setConfig - replace the settings of the chaincode
+// ============================================================
+func (t *SellingChaincode) SetConfig(ctx contractapi.TransactionContextInterface, c config) (*config, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start setConfig")
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, adminRole); err != nil {
+		return nil, errors.New("Only an " + adminRole + " may change the configuration")
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if err := putConfig(stub, &c); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end setConfig")
+	return &c, nil
+}
+
+// ==================================================
+// queryConfig - the settings of the chaincode
+// ==================================================
+func (t *SellingChaincode) QueryConfig(ctx contractapi.TransactionContextInterface) (*config, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start queryConfig")
+	c, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end queryConfig")
+	return c, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Callers whose certificate carries role=manager may override a credit limit.
+const (
+	roleAttribute = "role"
+	managerRole   = "manager"
+)
+
+// receivable is the amount a customer owes, to one company in each record
+// and over all companies when read by getReceivable.
+type receivable struct {
+	Client    string  `json:"client"`
+	CompanyID string  `json:"company_id,omitempty" metadata:",optional"`
+	Balance   float64 `json:"balance"`
+}
+
+// creditOverride records the manager who let a sale exceed the customer's
+// credit limit, and the numbers they approved.
+type creditOverride struct {
+	ApprovedBy string  `json:"approved_by"`
+	Limit      float64 `json:"limit"`
+	Balance    float64 `json:"balance"`
+	Amount     float64 `json:"amount"`
+}
+
+// amount is what the customer is charged for a sale, the money of its lines
+// plus tax.
+func (s *selling) amount() float64 {
+	var total float64
+	for _, line := range s.Items {
+		total += line.Money + line.Tax
+	}
+	return round2(total)
+}
+
+// receivableKey keys what a customer owes one company, so the company's
+// owner endorses it. Balances from before were kept per customer under
+// ("balance", client) and still count towards the total.
+func receivableKey(stub shim.ChaincodeStubInterface, client string, companyID string) (string, error) {
+	return stub.CreateCompositeKey("balance", []string{client, companyID})
+}
+
+// getReceivable sums what a customer owes over all companies.
+func getReceivable(stub shim.ChaincodeStubInterface, client string) (*receivable, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("balance", []string{client})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	r := &receivable{Client: client}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var balance receivable
+		if err := json.Unmarshal(response.Value, &balance); err != nil {
+			return nil, fmt.Errorf("Failed to decode JSON of: %s", response.Key)
+		}
+		r.Balance += balance.Balance
+	}
+	r.Balance = round2(r.Balance)
+	return r, nil
+}
+
+// addReceivable moves what a customer owes a company by amount, which is
+// negative for payments and reversals.
+func addReceivable(stub shim.ChaincodeStubInterface, client string, companyID string, amount float64) error {
+	key, err := receivableKey(stub, client, companyID)
+	if err != nil {
+		return err
+	}
+	balanceAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	r := &receivable{Client: client, CompanyID: companyID}
+	if balanceAsBytes != nil {
+		if err := json.Unmarshal(balanceAsBytes, r); err != nil {
+			return fmt.Errorf("Failed to decode JSON of: %s", key)
+		}
+	}
+	r.Balance = round2(r.Balance + amount)
+
+	balanceJSONasBytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return putByOwner(stub, companyID, key, balanceJSONasBytes)
+}
+
+// endorseReceivables puts what customers owe a company under the
+// endorsement of mspID.
+func endorseReceivables(stub shim.ChaincodeStubInterface, companyID string, mspID string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("balance", []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		_, attributes, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			return err
+		}
+		if len(attributes) != 2 || attributes[1] != companyID {
+			continue
+		}
+		if err := endorseBy(stub, response.Key, mspID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// creditLimit reads the credit limit of a customer from the party chaincode.
+// A customer without a limit returns nil.
+func creditLimit(stub shim.ChaincodeStubInterface, client string) (*float64, error) {
+	response := stub.InvokeChaincode(partyChaincode, [][]byte{[]byte("query"), []byte(client)}, "")
+	if response.Status != shim.OK {
+		return nil, fmt.Errorf("Failed to get party %s: %s", client, response.Message)
+	}
+	var p struct {
+		CreditLimit *float64 `json:"credit_limit"`
+	}
+	if err := json.Unmarshal(response.Payload, &p); err != nil {
+		return nil, fmt.Errorf("Invalid party returned for %s", client)
+	}
+	return p.CreditLimit, nil
+}
+
+// checkCredit fails if adding amount to the customer's balance exceeds the
+// credit limit. With override set a manager may allow it anyway; the returned
+// creditOverride is then kept on the sale.
+func checkCredit(stub shim.ChaincodeStubInterface, client string, amount float64, override bool) (*creditOverride, error) {
+	limit, err := creditLimit(stub, client)
+	if err != nil {
+		return nil, err
+	}
+	r, err := getReceivable(stub, client)
+	if err != nil {
+		return nil, err
+	}
+	if limit == nil || r.Balance+amount <= *limit {
+		return nil, nil
+	}
+	if !override {
+		return nil, fmt.Errorf("The sale of %.2f would take %s to %.2f, over its credit limit of %.2f", amount, client, r.Balance+amount, *limit)
+	}
+
+	if err := cid.AssertAttributeValue(stub, roleAttribute, managerRole); err != nil {
+		return nil, fmt.Errorf("Only a %s may override the credit limit of %s", managerRole, client)
+	}
+	approvedBy, err := callerIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	return &creditOverride{
+		ApprovedBy: approvedBy,
+		Limit:      *limit,
+		Balance:    r.Balance,
+		Amount:     amount,
+	}, nil
+}
+
+// callerIdentity names the submitter as MSP ID and certificate common name,
+// e.g. "Org1MSP/Jim".
+func callerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return "", err
+	}
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "/" + cert.Subject.CommonName, nil
+}
+
+// ==================================================
+// balance - outstanding receivable of a customer
+// ==================================================
+func (t *SellingChaincode) Balance(ctx contractapi.TransactionContextInterface, client string) (*receivable, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start balance")
+	// ==== Input sanitation ====
+	if len(client) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	r, err := getReceivable(stub, client)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end balance")
+	return r, nil
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
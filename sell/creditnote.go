@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// creditLine credits part of a sold spec. With how > 0 the tyres come back
+// into stock and money defaults to their share of the sale; with how 0 it is
+// a price allowance of money. Tax is reversed at the sale's rate, not
+// today's.
+type creditLine struct {
+	SpecID  int      `json:"spec_id"`
+	How     int      `json:"how" metadata:",optional"`
+	Money   float64  `json:"money" metadata:",optional"`
+	Serials []string `json:"serials,omitempty" metadata:",optional"`
+	TaxCode string   `json:"tax_code,omitempty" metadata:",optional"`
+	TaxRate float64  `json:"tax_rate,omitempty" metadata:",optional"`
+	Tax     float64  `json:"tax" metadata:",optional"`
+}
+
+// creditNote credits a sale, for returned tyres or a price allowance.
+// credit_id is left out when the company's sequence allocates it.
+type creditNote struct {
+	CompanyID string       `json:"company_id"`
+	CreditID  int          `json:"credit_id" metadata:",optional"`
+	CreditNo  string       `json:"credit_no,omitempty" metadata:",optional"`
+	OrderID   int          `json:"order_id"`
+	AccTime   int64        `json:"acc_time"`
+	Location  string       `json:"location,omitempty" metadata:",optional"`
+	Reason    string       `json:"reason" metadata:",optional"`
+	Items     []creditLine `json:"items"`
+	Amount    float64      `json:"amount" metadata:",optional"`
+}
+
+// soldSpec is what a sale sold of one spec, over all its lines.
+type soldSpec struct {
+	how     int
+	money   float64
+	cogs    float64
+	taxCode string
+	taxRate float64
+}
+
+// priceCredit prices cn's lines from the sale s it credits and counts them
+// as credited on s. It returns the tax entry reversing the sale's tax and
+// the tyres that come back into stock at their cost.
+func priceCredit(saleKey string, s *selling, costs *sellingCosts, cn *creditNote) (*taxEntry, []stockLine, error) {
+	sold := map[int]*soldSpec{}
+	for i, l := range s.Items {
+		ss, ok := sold[l.SpecID]
+		if !ok {
+			ss = &soldSpec{taxCode: l.TaxCode, taxRate: l.TaxRate}
+			sold[l.SpecID] = ss
+		}
+		ss.how += l.How
+		ss.money += l.Money
+		ss.cogs += costs.Items[i].COGS
+	}
+	if s.Credited == nil {
+		s.Credited = map[string]int{}
+	}
+
+	entry := &taxEntry{
+		CompanyID: cn.CompanyID,
+		DocType:   "credit_note",
+		DocID:     strconv.Itoa(cn.CreditID),
+		AccTime:   cn.AccTime,
+		Lines:     []taxLine{},
+	}
+	returned := []stockLine{}
+	cn.Amount = 0
+	for i := range cn.Items {
+		l := &cn.Items[i]
+		ss, ok := sold[l.SpecID]
+		if !ok {
+			return nil, nil, fmt.Errorf("The sale %s has no spec_id %d", saleKey, l.SpecID)
+		}
+		if l.How < 0 || (l.How == 0 && l.Money <= 0) {
+			return nil, nil, fmt.Errorf("spec_id %d must credit a positive how or money", l.SpecID)
+		}
+		specID := strconv.Itoa(l.SpecID)
+		if s.Credited[specID]+l.How > ss.how {
+			return nil, nil, fmt.Errorf("Only %d of spec_id %d are left to credit on %s", ss.how-s.Credited[specID], l.SpecID, saleKey)
+		}
+		s.Credited[specID] += l.How
+
+		if l.How > 0 {
+			if l.Money == 0 {
+				l.Money = round2(ss.money / float64(ss.how) * float64(l.How))
+			}
+			cogs := round2(ss.cogs / float64(ss.how) * float64(l.How))
+			returned = append(returned, stockLine{SpecID: l.SpecID, How: l.How, Money: cogs, Serials: l.Serials})
+		}
+		l.TaxCode = ss.taxCode
+		l.TaxRate = ss.taxRate
+		l.Tax = round2(l.Money * l.TaxRate / 100)
+		cn.Amount += l.Money + l.Tax
+		if l.TaxCode != "" {
+			entry.Lines = append(entry.Lines, taxLine{TaxCode: l.TaxCode, Rate: l.TaxRate, Base: -l.Money, Tax: -l.Tax})
+		}
+	}
+	cn.Amount = round2(cn.Amount)
+	if s.CreditedAmount+cn.Amount > s.amount()+0.005 {
+		return nil, nil, fmt.Errorf("The sale %s has only %.2f left to credit", saleKey, s.amount()-s.CreditedAmount)
+	}
+	return entry, returned, nil
+}
+
+// ============================================================
+// creditNote - credit a sale and reverse its tax
+// ============================================================
+func (t *SellingChaincode) CreditNote(ctx contractapi.TransactionContextInterface, cn creditNote) (*creditNote, error) {
+	stub := ctx.GetStub()
+	var err error
+
+	// ==== Input sanitation ====
+	fmt.Println("- start creditNote")
+	if cn.CompanyID == "" {
+		return nil, errors.New("company_id must be required")
+	}
+	if cn.OrderID == 0 {
+		return nil, errors.New("order_id must be required")
+	}
+	if len(cn.Items) == 0 {
+		return nil, errors.New("items must be required")
+	}
+	creditNo, err := nextNumber(stub, cn.CompanyID, "credit_note", cn.AccTime, "credit_id", &cn.CreditID)
+	if err != nil {
+		return nil, err
+	}
+	if creditNo != "" {
+		cn.CreditNo = creditNo
+	}
+	if err := checkPeriod(stub, cn.CompanyID, cn.AccTime); err != nil {
+		return nil, err
+	}
+
+	key, err := stub.CreateCompositeKey("credit", []string{cn.CompanyID, strconv.Itoa(cn.CreditID)})
+	if err != nil {
+		return nil, err
+	}
+	creditAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get credit note: " + err.Error())
+	} else if creditAsBytes != nil {
+		msg := fmt.Sprintf("The credit note %s-%d has already existed!", cn.CompanyID, cn.CreditID)
+		return nil, errors.New(msg)
+	}
+
+	saleKey := fmt.Sprintf("%s-%s", cn.CompanyID, strconv.Itoa(cn.OrderID))
+	saleAsBytes, err := stub.GetState(saleKey)
+	if err != nil {
+		return nil, errors.New("Failed to get item: " + err.Error())
+	} else if saleAsBytes == nil {
+		return nil, errors.New("This item NOT exists: " + saleKey)
+	}
+	s := selling{}
+	if err := decodeSelling(saleAsBytes, &s); err != nil {
+		return nil, err
+	}
+	// returned tyres go back into stock at the cost they were sold at
+	costs, err := getCosts(stub, saleKey, &s)
+	if err != nil {
+		return nil, err
+	} else if costs == nil {
+		return nil, errors.New("The costs of " + saleKey + " are not held by this peer")
+	}
+
+	// ==== Price the lines from the sale ====
+	entry, returned, err := priceCredit(saleKey, &s, costs, &cn)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==== Put returned tyres back into stock at their cost ====
+	if len(returned) > 0 {
+		receipt := stockMove{
+			CompanyID: cn.CompanyID,
+			OrderID:   cn.CreditID,
+			Client:    s.Client,
+			AccTime:   cn.AccTime,
+			Location:  cn.Location,
+			Items:     returned,
+		}
+		receiptJSONasBytes, err := json.Marshal(receipt)
+		if err != nil {
+			return nil, err
+		}
+		response := stub.InvokeChaincode(storeChaincode, [][]byte{[]byte("receive"), receiptJSONasBytes}, "")
+		if response.Status != shim.OK {
+			return nil, errors.New("Failed to return into store: " + response.Message)
+		}
+	}
+
+	// ==== Reduce what the customer owes ====
+	s.CreditedAmount = round2(s.CreditedAmount + cn.Amount)
+	s.applyPayment()
+	if err := indexOpen(stub, &s); err != nil {
+		return nil, err
+	}
+	if err := addReceivable(stub, s.Client, s.CompanyID, -cn.Amount); err != nil {
+		return nil, err
+	}
+	if err := putTaxEntry(stub, entry); err != nil {
+		return nil, err
+	}
+
+	if err := putSelling(stub, saleKey, &s); err != nil {
+		return nil, err
+	}
+	creditJSONasBytes, err := json.Marshal(cn)
+	if err != nil {
+		return nil, err
+	}
+	if err := putByOwner(stub, cn.CompanyID, key, creditJSONasBytes); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end creditNote")
+	return &cn, nil
+}
+
+// ==================================================
+// queryCreditNote - query a credit note by company and ID
+// ==================================================
+func (t *SellingChaincode) QueryCreditNote(ctx contractapi.TransactionContextInterface, companyID string, creditID string) (*creditNote, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start queryCreditNote")
+	key, err := stub.CreateCompositeKey("credit", []string{companyID, creditID})
+	if err != nil {
+		return nil, err
+	}
+	creditAsBytes, err := stub.GetState(key)
+	if err != nil {
+		jsonResp := "{\"Error\":\"Failed to get state for " + companyID + "-" + creditID + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+	if creditAsBytes == nil {
+		jsonResp := "{\"Error\":\"Nil credit note for " + companyID + "-" + creditID + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	var cn creditNote
+	if err := json.Unmarshal(creditAsBytes, &cn); err != nil {
+		return nil, errors.New("Failed to decode JSON of credit note: " + companyID + "-" + creditID)
+	}
+
+	fmt.Println("- end queryCreditNote")
+	return &cn, nil
+}
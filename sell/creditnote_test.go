@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPriceCredit(t *testing.T) {
+	tests := []struct {
+		name     string
+		credited map[string]int
+		amount   float64
+		items    []creditLine
+		lines    []taxLine
+		returned []stockLine
+		total    float64
+		wantErr  bool
+	}{
+		{
+			name:     "returned at the sale price",
+			items:    []creditLine{{SpecID: 1111, How: 1}},
+			lines:    []taxLine{{TaxCode: "VAT", Rate: 10, Base: -100, Tax: -10}},
+			returned: []stockLine{{SpecID: 1111, How: 1, Money: 60}},
+			total:    110,
+		},
+		{
+			name:     "returned at a given price",
+			items:    []creditLine{{SpecID: 1111, How: 1, Money: 90}},
+			lines:    []taxLine{{TaxCode: "VAT", Rate: 10, Base: -90, Tax: -9}},
+			returned: []stockLine{{SpecID: 1111, How: 1, Money: 60}},
+			total:    99,
+		},
+		{
+			name:     "price allowance",
+			items:    []creditLine{{SpecID: 1111, Money: 20}},
+			lines:    []taxLine{{TaxCode: "VAT", Rate: 10, Base: -20, Tax: -2}},
+			returned: []stockLine{},
+			total:    22,
+		},
+		{
+			name:     "untaxed spec",
+			items:    []creditLine{{SpecID: 2222, How: 1, Serials: []string{"S1"}}},
+			lines:    []taxLine{},
+			returned: []stockLine{{SpecID: 2222, How: 1, Money: 30, Serials: []string{"S1"}}},
+			total:    50,
+		},
+		{
+			name:     "both specs",
+			items:    []creditLine{{SpecID: 1111, How: 4}, {SpecID: 2222, Money: 10}},
+			lines:    []taxLine{{TaxCode: "VAT", Rate: 10, Base: -400, Tax: -40}},
+			returned: []stockLine{{SpecID: 1111, How: 4, Money: 240}},
+			total:    450,
+		},
+		{
+			name:    "spec not sold",
+			items:   []creditLine{{SpecID: 3333, How: 1}},
+			wantErr: true,
+		},
+		{
+			name:    "neither how nor money",
+			items:   []creditLine{{SpecID: 1111}},
+			wantErr: true,
+		},
+		{
+			name:    "more than sold",
+			items:   []creditLine{{SpecID: 1111, How: 5}},
+			wantErr: true,
+		},
+		{
+			name:     "more than left after earlier credits",
+			credited: map[string]int{"1111": 3},
+			items:    []creditLine{{SpecID: 1111, How: 2}},
+			wantErr:  true,
+		},
+		{
+			name:    "more money than left",
+			amount:  480,
+			items:   []creditLine{{SpecID: 1111, Money: 20}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := selling{
+				CompanyID: "3",
+				OrderID:   7,
+				Items: []subSelling{
+					{SpecID: 1111, How: 2, Money: 200, TaxCode: "VAT", TaxRate: 10, Tax: 20},
+					{SpecID: 1111, How: 2, Money: 200, TaxCode: "VAT", TaxRate: 10, Tax: 20},
+					{SpecID: 2222, How: 1, Money: 50},
+				},
+				Credited:       tt.credited,
+				CreditedAmount: tt.amount,
+			}
+			costs := sellingCosts{CompanyID: "3", OrderID: 7, Items: []costLine{
+				{SpecID: 1111, How: 2, COGS: 120},
+				{SpecID: 1111, How: 2, COGS: 120},
+				{SpecID: 2222, How: 1, COGS: 30},
+			}}
+			cn := creditNote{CompanyID: "3", CreditID: 1, OrderID: 7, Items: tt.items}
+
+			entry, returned, err := priceCredit("3-7", &s, &costs, &cn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if entry.DocType != "credit_note" || entry.DocID != "1" {
+				t.Errorf("entry = %s %s, want credit_note 1", entry.DocType, entry.DocID)
+			}
+			if !reflect.DeepEqual(entry.Lines, tt.lines) {
+				t.Errorf("tax lines = %+v, want %+v", entry.Lines, tt.lines)
+			}
+			if !reflect.DeepEqual(returned, tt.returned) {
+				t.Errorf("returned = %+v, want %+v", returned, tt.returned)
+			}
+			if cn.Amount != tt.total {
+				t.Errorf("amount = %v, want %v", cn.Amount, tt.total)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// document is an off-chain file, such as an invoice PDF or a scanned
+// delivery note, anchored to an order by its SHA-256.
+type document struct {
+	Key        string `json:"key"`
+	DocType    string `json:"doc_type"`
+	SHA256     string `json:"sha256"`
+	URI        string `json:"uri"`
+	Size       int64  `json:"size"`
+	AttachedBy string `json:"attached_by"`
+	AttachedAt int64  `json:"attached_at"`
+	TxID       string `json:"tx_id"`
+}
+
+type verification struct {
+	Valid    bool      `json:"valid"`
+	Document *document `json:"document,omitempty" metadata:",optional"`
+}
+
+// ============================================================
+// attachDocument - anchor the hash of a file to an order
+// ============================================================
+func (t *SellingChaincode) AttachDocument(ctx contractapi.TransactionContextInterface, key string, docType string, sha256 string, uri string, size int64) error {
+	stub := ctx.GetStub()
+	// ==== Input sanitation ====
+	fmt.Println("- start attachDocument")
+	for n, arg := range []string{key, docType, sha256, uri} {
+		if len(arg) <= 0 {
+			return fmt.Errorf("argument %d must be a non-empty string", n+1)
+		}
+	}
+	sum := strings.ToLower(sha256)
+	if raw, err := hex.DecodeString(sum); err != nil || len(raw) != 32 {
+		return errors.New("3rd argument must be a hex SHA-256")
+	}
+	if size < 0 {
+		return errors.New("5th argument must not be negative")
+	}
+
+	// ==== Check the order exists ====
+	itemAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errors.New("Failed to get item: " + err.Error())
+	} else if itemAsBytes == nil {
+		return errors.New("This item NOT exists: " + key)
+	}
+
+	docKey, err := stub.CreateCompositeKey("doc", []string{key, sum})
+	if err != nil {
+		return err
+	}
+	docAsBytes, err := stub.GetState(docKey)
+	if err != nil {
+		return errors.New("Failed to get document: " + err.Error())
+	} else if docAsBytes != nil {
+		return fmt.Errorf("The document %s has already been attached to %s!", sum, key)
+	}
+
+	attachedBy, err := callerIdentity(stub)
+	if err != nil {
+		return err
+	}
+	txTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	doc := document{
+		Key:        key,
+		DocType:    docType,
+		SHA256:     sum,
+		URI:        uri,
+		Size:       size,
+		AttachedBy: attachedBy,
+		AttachedAt: txTime.Seconds,
+		TxID:       stub.GetTxID(),
+	}
+	docJSONasBytes, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := putWithDocument(stub, key, docKey, docJSONasBytes); err != nil {
+		return err
+	}
+
+	fmt.Println("- end attachDocument")
+	return nil
+}
+
+// ==================================================
+// verifyDocument - check a file's SHA-256 against an order
+// ==================================================
+func (t *SellingChaincode) VerifyDocument(ctx contractapi.TransactionContextInterface, key string, sha256 string) (*verification, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start verifyDocument")
+	docKey, err := stub.CreateCompositeKey("doc", []string{key, strings.ToLower(sha256)})
+	if err != nil {
+		return nil, err
+	}
+	docAsBytes, err := stub.GetState(docKey)
+	if err != nil {
+		return nil, errors.New("Failed to get document: " + err.Error())
+	}
+
+	v := verification{}
+	if docAsBytes != nil {
+		v.Valid = true
+		v.Document = &document{}
+		if err := json.Unmarshal(docAsBytes, v.Document); err != nil {
+			return nil, errors.New("Failed to decode JSON of document: " + sha256)
+		}
+	}
+
+	fmt.Println("- end verifyDocument")
+	return &v, nil
+}
+
+// ==================================================
+// documents - list the documents attached to an order
+// ==================================================
+func (t *SellingChaincode) Documents(ctx contractapi.TransactionContextInterface, key string) ([]document, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start documents")
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("doc", []string{key})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	docs := []document{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var doc document
+		if err := json.Unmarshal(response.Value, &doc); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		docs = append(docs, doc)
+	}
+
+	fmt.Println("- end documents")
+	return docs, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/statebased"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Callers whose certificate carries role=admin may move a company to another
+// organisation.
+const adminRole = "admin"
+
+// owner is the organisation whose peers must endorse every change to the
+// documents of a company. Only an admin assigns it, with setOwner; no
+// document may be created for a company before it has an owner.
+type owner struct {
+	CompanyID string `json:"company_id"`
+	MSPID     string `json:"msp_id"`
+}
+
+func ownerKey(stub shim.ChaincodeStubInterface, companyID string) (string, error) {
+	return stub.CreateCompositeKey("owner", []string{companyID})
+}
+
+func putOwner(stub shim.ChaincodeStubInterface, o *owner) error {
+	key, err := ownerKey(stub, o.CompanyID)
+	if err != nil {
+		return err
+	}
+	ownerJSONasBytes, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, ownerJSONasBytes)
+}
+
+// getOwner returns the owning organisation of a company, "" if it has none.
+func getOwner(stub shim.ChaincodeStubInterface, companyID string) (string, error) {
+	key, err := ownerKey(stub, companyID)
+	if err != nil {
+		return "", err
+	}
+	ownerAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	if ownerAsBytes == nil {
+		return "", nil
+	}
+	var o owner
+	if err := json.Unmarshal(ownerAsBytes, &o); err != nil {
+		return "", fmt.Errorf("Failed to decode JSON of: %s", key)
+	}
+	return o.MSPID, nil
+}
+
+// ownerOf returns the owning organisation of a company, failing for a
+// company that has none.
+func ownerOf(stub shim.ChaincodeStubInterface, companyID string) (string, error) {
+	mspID, err := getOwner(stub, companyID)
+	if err != nil {
+		return "", err
+	}
+	if mspID == "" {
+		return "", fmt.Errorf("Company %s has no owner, an %s must setOwner first", companyID, adminRole)
+	}
+	return mspID, nil
+}
+
+// memberPolicy is the key-level endorsement policy of any member of mspID.
+func memberPolicy(mspID string) ([]byte, error) {
+	ep, err := statebased.NewStateEP(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := ep.AddOrgs(statebased.RoleTypeMember, mspID); err != nil {
+		return nil, err
+	}
+	return ep.Policy()
+}
+
+// endorseBy requires a member of mspID to endorse future changes of key.
+func endorseBy(stub shim.ChaincodeStubInterface, key string, mspID string) error {
+	policy, err := memberPolicy(mspID)
+	if err != nil {
+		return err
+	}
+	return stub.SetStateValidationParameter(key, policy)
+}
+
+// endorsePrivateBy requires a member of mspID to endorse future changes of a
+// key in a private data collection.
+func endorsePrivateBy(stub shim.ChaincodeStubInterface, collection string, key string, mspID string) error {
+	policy, err := memberPolicy(mspID)
+	if err != nil {
+		return err
+	}
+	return stub.SetPrivateDataValidationParameter(collection, key, policy)
+}
+
+// endorseByOwner puts a new document of a company under the key-level
+// endorsement of its owning organisation.
+func endorseByOwner(stub shim.ChaincodeStubInterface, companyID string, key string) error {
+	mspID, err := ownerOf(stub, companyID)
+	if err != nil {
+		return err
+	}
+	return endorseBy(stub, key, mspID)
+}
+
+// putByOwner saves a key of a company, such as a sequence or a payment, under the
+// key-level endorsement of its owning organisation.
+func putByOwner(stub shim.ChaincodeStubInterface, companyID string, key string, value []byte) error {
+	if err := stub.PutState(key, value); err != nil {
+		return err
+	}
+	return endorseByOwner(stub, companyID, key)
+}
+
+// putWithDocument saves a record of a document, such as an attached file,
+// under the same key-level endorsement as the document.
+func putWithDocument(stub shim.ChaincodeStubInterface, docKey string, key string, value []byte) error {
+	if err := stub.PutState(key, value); err != nil {
+		return err
+	}
+	policy, err := stub.GetStateValidationParameter(docKey)
+	if err != nil || policy == nil {
+		return err
+	}
+	return stub.SetStateValidationParameter(key, policy)
+}
+
+// endorseKeys puts the existing keys of objectType starting with attributes,
+// such as the sequences of a company, under the key-level endorsement of
+// mspID.
+func endorseKeys(stub shim.ChaincodeStubInterface, objectType string, attributes []string, mspID string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if err := endorseBy(stub, response.Key, mspID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// setOwner - assign the owning organisation of a company, or move a company
+// and its existing documents to the key-level endorsement of another
+// organisation. The current owner's peers must endorse a move.
+// args: company_id, msp_id
+// ============================================================
+func (t *SellingChaincode) SetOwner(ctx contractapi.TransactionContextInterface, companyID string, mspID string) error {
+	stub := ctx.GetStub()
+	fmt.Println("- start setOwner")
+	if len(companyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
+	}
+	if len(mspID) <= 0 {
+		return errors.New("2nd argument must be a non-empty string")
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, adminRole); err != nil {
+		return errors.New("Only an " + adminRole + " may change the owner of a company")
+	}
+
+	if err := putOwner(stub, &owner{CompanyID: companyID, MSPID: mspID}); err != nil {
+		return err
+	}
+	collection := mspID + "Margins"
+
+	// the documents of a company are keyed "<company_id>-<order_id>"
+	resultsIterator, err := stub.GetStateByRange(companyID+"-", companyID+".")
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if err := endorseBy(stub, response.Key, mspID); err != nil {
+			return err
+		}
+		if err := endorseKeys(stub, "doc", []string{response.Key}, mspID); err != nil {
+			return err
+		}
+
+		// the costs of the sales follow the company into the new owner's
+		// collection
+		var s selling
+		if err := decodeSelling(response.Value, &s); err != nil {
+			return errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		if s.CostCollection == "" || s.CostCollection == collection {
+			continue
+		}
+		if err := moveMargins(stub, response.Key, &s, mspID); err != nil {
+			return err
+		}
+		if err := putSelling(stub, response.Key, &s); err != nil {
+			return err
+		}
+	}
+	for _, objectType := range []string{"open~sale", "credit", "payment", "seq", "request", "company~tabno", "tax"} {
+		if err := endorseKeys(stub, objectType, []string{companyID}, mspID); err != nil {
+			return err
+		}
+	}
+	if err := endorseReceivables(stub, companyID, mspID); err != nil {
+		return err
+	}
+
+	fmt.Println("- end setOwner")
+	return nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Payment status of a sale.
+const (
+	statusUnpaid  = "unpaid"
+	statusPartial = "partial"
+	statusPaid    = "paid"
+)
+
+// allocation is the part of a payment applied to one sale of the payment's
+// company.
+type allocation struct {
+	OrderID int     `json:"order_id"`
+	Amount  float64 `json:"amount"`
+}
+
+type payment struct {
+	CompanyID   string       `json:"company_id"`
+	PaymentID   string       `json:"payment_id"`
+	Client      string       `json:"client"`
+	PayTime     int64        `json:"pay_time"`
+	Amount      float64      `json:"amount"`
+	Allocations []allocation `json:"allocations"`
+}
+
+// agingLine is the outstanding amount of one customer by age of the sale,
+// counted in days from acc_time.
+type agingLine struct {
+	Client  string  `json:"client"`
+	Current float64 `json:"current"`
+	Days30  float64 `json:"days_30"`
+	Days60  float64 `json:"days_60"`
+	Days90  float64 `json:"days_90_plus"`
+	Total   float64 `json:"total"`
+}
+
+func (a *agingLine) add(age int64, amount float64) {
+	switch {
+	case age < 30:
+		a.Current += amount
+	case age < 60:
+		a.Days30 += amount
+	case age < 90:
+		a.Days60 += amount
+	default:
+		a.Days90 += amount
+	}
+	a.Total += amount
+}
+
+func (a *agingLine) round() {
+	a.Current = round2(a.Current)
+	a.Days30 = round2(a.Days30)
+	a.Days60 = round2(a.Days60)
+	a.Days90 = round2(a.Days90)
+	a.Total = round2(a.Total)
+}
+
+// applyPayment sets outstanding and status of a sale after paid or credited
+// has changed.
+func (s *selling) applyPayment() {
+	s.Outstanding = round2(s.amount() - s.Paid - s.CreditedAmount)
+	switch {
+	case s.Outstanding <= 0:
+		s.Status = statusPaid
+	case s.Paid == 0:
+		s.Status = statusUnpaid
+	case s.Outstanding > 0:
+		s.Status = statusPartial
+	default:
+		s.Status = statusPaid
+	}
+}
+
+// openKey indexes sales with an outstanding amount by company and client, so
+// aging does not have to read paid sales.
+func openKey(stub shim.ChaincodeStubInterface, s *selling) (string, error) {
+	return stub.CreateCompositeKey("open~sale", []string{s.CompanyID, s.Client, strconv.Itoa(s.OrderID)})
+}
+
+// indexOpen adds or removes a sale from the open index to match its status.
+func indexOpen(stub shim.ChaincodeStubInterface, s *selling) error {
+	key, err := openKey(stub, s)
+	if err != nil {
+		return err
+	}
+	if s.Status == statusPaid {
+		return stub.DelState(key)
+	}
+	return putByOwner(stub, s.CompanyID, key, []byte{0x00})
+}
+
+// mergeAllocations adds up the allocations of a payment to the same sale, so
+// each sale is read and written once.
+func mergeAllocations(allocations []allocation) ([]allocation, error) {
+	merged := []allocation{}
+	index := map[int]int{}
+	for _, a := range allocations {
+		if a.Amount <= 0 {
+			return nil, fmt.Errorf("amount allocated to order %d must be positive", a.OrderID)
+		}
+		if i, ok := index[a.OrderID]; ok {
+			merged[i].Amount = round2(merged[i].Amount + a.Amount)
+			continue
+		}
+		index[a.OrderID] = len(merged)
+		merged = append(merged, a)
+	}
+	return merged, nil
+}
+
+// ============================================================
+// pay - record a payment and allocate it against sales
+// ============================================================
+func (t *SellingChaincode) Pay(ctx contractapi.TransactionContextInterface, p payment) error {
+	stub := ctx.GetStub()
+	var err error
+
+	// ==== Input sanitation ====
+	fmt.Println("- start pay")
+	if p.CompanyID == "" {
+		return errors.New("company_id must be required")
+	}
+	if p.PaymentID == "" {
+		return errors.New("payment_id must be required")
+	}
+	if len(p.Allocations) == 0 {
+		return errors.New("allocations must be required")
+	}
+	if err := checkPeriod(stub, p.CompanyID, p.PayTime); err != nil {
+		return err
+	}
+
+	key, err := stub.CreateCompositeKey("payment", []string{p.CompanyID, p.PaymentID})
+	if err != nil {
+		return err
+	}
+	paymentAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errors.New("Failed to get payment: " + err.Error())
+	} else if paymentAsBytes != nil {
+		msg := fmt.Sprintf("The payment %s-%s has already existed!", p.CompanyID, p.PaymentID)
+		return errors.New(msg)
+	}
+
+	allocations, err := mergeAllocations(p.Allocations)
+	if err != nil {
+		return err
+	}
+	p.Allocations = allocations
+
+	var allocated float64
+	for _, a := range p.Allocations {
+		allocated += a.Amount
+
+		saleKey := fmt.Sprintf("%s-%s", p.CompanyID, strconv.Itoa(a.OrderID))
+		saleAsBytes, err := stub.GetState(saleKey)
+		if err != nil {
+			return errors.New("Failed to get item: " + err.Error())
+		} else if saleAsBytes == nil {
+			return errors.New("This item NOT exists: " + saleKey)
+		}
+		s := selling{}
+		if err := decodeSelling(saleAsBytes, &s); err != nil {
+			return err
+		}
+		if s.Client != p.Client {
+			return fmt.Errorf("The sale %s was made to %s, not %s", saleKey, s.Client, p.Client)
+		}
+		if round2(a.Amount) > s.Outstanding {
+			return fmt.Errorf("The sale %s has only %.2f outstanding", saleKey, s.Outstanding)
+		}
+
+		s.Paid = round2(s.Paid + a.Amount)
+		s.applyPayment()
+		if err := indexOpen(stub, &s); err != nil {
+			return err
+		}
+		if err := putSelling(stub, saleKey, &s); err != nil {
+			return err
+		}
+	}
+	if round2(allocated) != round2(p.Amount) {
+		return fmt.Errorf("allocations total %.2f, payment amount is %.2f", allocated, p.Amount)
+	}
+
+	if err := addReceivable(stub, p.Client, p.CompanyID, -p.Amount); err != nil {
+		return err
+	}
+
+	paymentJSONasBytes, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	err = putByOwner(stub, p.CompanyID, key, paymentJSONasBytes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("- end pay")
+	return nil
+}
+
+// ==================================================
+// queryPayment - query a payment by company and ID
+// ==================================================
+func (t *SellingChaincode) QueryPayment(ctx contractapi.TransactionContextInterface, companyID string, paymentID string) (*payment, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start queryPayment")
+	key, err := stub.CreateCompositeKey("payment", []string{companyID, paymentID})
+	if err != nil {
+		return nil, err
+	}
+	paymentAsBytes, err := stub.GetState(key)
+	if err != nil {
+		jsonResp := "{\"Error\":\"Failed to get state for " + companyID + "-" + paymentID + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+	if paymentAsBytes == nil {
+		jsonResp := "{\"Error\":\"Nil payment for " + companyID + "-" + paymentID + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	var p payment
+	if err := json.Unmarshal(paymentAsBytes, &p); err != nil {
+		return nil, errors.New("Failed to decode JSON of payment: " + companyID + "-" + paymentID)
+	}
+
+	fmt.Println("- end queryPayment")
+	return &p, nil
+}
+
+// ==================================================
+// aging - outstanding receivables of a company by customer and age
+// ==================================================
+func (t *SellingChaincode) Aging(ctx contractapi.TransactionContextInterface, companyID string, client string) ([]agingLine, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start aging")
+	// ==== Input sanitation ====
+	if len(companyID) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	// ages are counted to the transaction time so every peer agrees
+	txTime, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := []string{companyID}
+	if client != "" {
+		attributes = append(attributes, client)
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("open~sale", attributes)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	lines := map[string]*agingLine{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			return nil, err
+		}
+		saleKey := fmt.Sprintf("%s-%s", keyParts[0], keyParts[2])
+		saleAsBytes, err := stub.GetState(saleKey)
+		if err != nil {
+			return nil, err
+		} else if saleAsBytes == nil {
+			continue
+		}
+		s := selling{}
+		if err := decodeSelling(saleAsBytes, &s); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + saleKey)
+		}
+
+		line, ok := lines[s.Client]
+		if !ok {
+			line = &agingLine{Client: s.Client}
+			lines[s.Client] = line
+		}
+		line.add((txTime.Seconds-s.AccTime)/86400, s.Outstanding)
+	}
+
+	report := make([]agingLine, 0, len(lines))
+	for _, line := range lines {
+		line.round()
+		report = append(report, *line)
+	}
+	sort.Slice(report, func(a, b int) bool { return report[a].Client < report[b].Client })
+
+	fmt.Println("- end aging")
+	return report, nil
+}
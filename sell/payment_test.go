@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeAllocations(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []allocation
+		want    []allocation
+		wantErr bool
+	}{
+		{
+			name: "one order",
+			in:   []allocation{{OrderID: 1, Amount: 100}},
+			want: []allocation{{OrderID: 1, Amount: 100}},
+		},
+		{
+			name: "same order twice",
+			in:   []allocation{{OrderID: 1, Amount: 0.1}, {OrderID: 1, Amount: 0.2}},
+			want: []allocation{{OrderID: 1, Amount: 0.3}},
+		},
+		{
+			name: "keeps first seen order",
+			in: []allocation{
+				{OrderID: 3, Amount: 30},
+				{OrderID: 1, Amount: 10},
+				{OrderID: 3, Amount: 5},
+				{OrderID: 2, Amount: 20},
+			},
+			want: []allocation{{OrderID: 3, Amount: 35}, {OrderID: 1, Amount: 10}, {OrderID: 2, Amount: 20}},
+		},
+		{
+			name:    "zero amount",
+			in:      []allocation{{OrderID: 1, Amount: 100}, {OrderID: 2, Amount: 0}},
+			wantErr: true,
+		},
+		{
+			name:    "negative amount",
+			in:      []allocation{{OrderID: 1, Amount: -5}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeAllocations(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPayment(t *testing.T) {
+	items := []subSelling{{SpecID: 1111, How: 4, Money: 400, Tax: 40}}
+	tests := []struct {
+		name        string
+		paid        float64
+		credited    float64
+		outstanding float64
+		status      string
+	}{
+		{name: "nothing paid", outstanding: 440, status: statusUnpaid},
+		{name: "part paid", paid: 100, outstanding: 340, status: statusPartial},
+		{name: "paid in full", paid: 440, outstanding: 0, status: statusPaid},
+		{name: "paid with a credit note", paid: 330, credited: 110, outstanding: 0, status: statusPaid},
+		{name: "credited only", credited: 110, outstanding: 330, status: statusUnpaid},
+		{name: "overpaid", paid: 500, outstanding: -60, status: statusPaid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := selling{CompanyID: "3", OrderID: 1, Items: items, Paid: tt.paid, CreditedAmount: tt.credited}
+			s.applyPayment()
+			if s.Outstanding != tt.outstanding || s.Status != tt.status {
+				t.Errorf("got %v %s, want %v %s", s.Outstanding, s.Status, tt.outstanding, tt.status)
+			}
+		})
+	}
+}
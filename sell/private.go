@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// costLine is the cost of one sold line, kept only in the private data
+// collection of the owner of the selling company.
+type costLine struct {
+	SpecID int     `json:"spec_id"`
+	How    int     `json:"how"`
+	COGS   float64 `json:"cogs"`
+	Margin float64 `json:"margin"`
+}
+
+type sellingCosts struct {
+	CompanyID string     `json:"company_id"`
+	OrderID   int        `json:"order_id"`
+	Items     []costLine `json:"items"`
+	COGS      float64    `json:"cogs"`
+	Margin    float64    `json:"margin"`
+}
+
+// hideCosts moves the cogs and margin of a sale into the owner's private
+// collection and leaves their hash and the collection name on the sale.
+func hideCosts(stub shim.ChaincodeStubInterface, key string, s *selling) error {
+	mspID, err := ownerOf(stub, s.CompanyID)
+	if err != nil {
+		return err
+	}
+
+	sc := sellingCosts{CompanyID: s.CompanyID, OrderID: s.OrderID, COGS: s.COGS, Margin: s.Margin}
+	for i := range s.Items {
+		sc.Items = append(sc.Items, costLine{
+			SpecID: s.Items[i].SpecID,
+			How:    s.Items[i].How,
+			COGS:   s.Items[i].COGS,
+			Margin: s.Items[i].Margin,
+		})
+		s.Items[i].COGS = 0
+		s.Items[i].Margin = 0
+	}
+	s.COGS = 0
+	s.Margin = 0
+	return putCosts(stub, mspID, key, s, &sc)
+}
+
+// putCosts saves the costs of a sale in the private data collection of the
+// owner of its company, e.g. "Org1MSPMargins", under the owner's
+// endorsement. Each organisation's collection is defined in
+// collections_config.json with only that organisation as member.
+func putCosts(stub shim.ChaincodeStubInterface, mspID string, key string, s *selling, sc *sellingCosts) error {
+	costsJSONasBytes, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	collection := mspID + "Margins"
+	if err := stub.PutPrivateData(collection, key, costsJSONasBytes); err != nil {
+		return err
+	}
+	if err := endorsePrivateBy(stub, collection, key, mspID); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(costsJSONasBytes)
+	s.CostHash = hex.EncodeToString(hash[:])
+	s.CostCollection = collection
+	return nil
+}
+
+// getCosts reads the cogs and margin of a sale. It returns nil when the
+// peer's organisation does not hold them.
+func getCosts(stub shim.ChaincodeStubInterface, key string, s *selling) (*sellingCosts, error) {
+	if s.CostCollection == "" {
+		// sales from before private costs carry them publicly
+		sc := &sellingCosts{CompanyID: s.CompanyID, OrderID: s.OrderID, COGS: s.COGS, Margin: s.Margin}
+		for _, l := range s.Items {
+			sc.Items = append(sc.Items, costLine{SpecID: l.SpecID, How: l.How, COGS: l.COGS, Margin: l.Margin})
+		}
+		return sc, nil
+	}
+	costsAsBytes, err := stub.GetPrivateData(s.CostCollection, key)
+	if err != nil || costsAsBytes == nil {
+		return nil, nil
+	}
+
+	hash := sha256.Sum256(costsAsBytes)
+	if hex.EncodeToString(hash[:]) != s.CostHash {
+		return nil, fmt.Errorf("The costs of %s do not match their hash", key)
+	}
+	var sc sellingCosts
+	if err := json.Unmarshal(costsAsBytes, &sc); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of costs: %s", key)
+	}
+	if len(sc.Items) != len(s.Items) {
+		return nil, fmt.Errorf("The costs of %s do not match its lines", key)
+	}
+	return &sc, nil
+}
+
+// revealCosts puts the cogs and margin back on a sale read from public
+// state. It returns false when the caller's organisation does not hold them.
+func revealCosts(stub shim.ChaincodeStubInterface, key string, s *selling) (bool, error) {
+	sc, err := getCosts(stub, key, s)
+	if err != nil || sc == nil {
+		return false, err
+	}
+	for i := range s.Items {
+		s.Items[i].COGS = sc.Items[i].COGS
+		s.Items[i].Margin = sc.Items[i].Margin
+	}
+	s.COGS = sc.COGS
+	s.Margin = sc.Margin
+	return true, nil
+}
+
+// moveMargins moves the private costs of a sale into the collection of the
+// company's new owner, mspID.
+func moveMargins(stub shim.ChaincodeStubInterface, key string, s *selling, mspID string) error {
+	sc, err := getCosts(stub, key, s)
+	if err != nil {
+		return err
+	} else if sc == nil {
+		return fmt.Errorf("The costs of %s are not held by this peer", key)
+	}
+	if err := stub.DelPrivateData(s.CostCollection, key); err != nil {
+		return err
+	}
+	return putCosts(stub, mspID, key, s, sc)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// schemaVersion is the shape of the sales this chaincode writes. Version 1 is
+// everything written before sales carried a version: company_id may be a
+// number, order_id a string, and lines may have f_how and price instead of
+// how and money. From version 3 the cogs and margin of a sale are kept in the
+// owner's margin collection.
+const schemaVersion = 3
+
+// migration is the result of one migrate batch. Bookmark is where the next
+// batch starts; it is empty when done.
+type migration struct {
+	Scanned  int    `json:"scanned"`
+	Migrated int    `json:"migrated"`
+	Bookmark string `json:"bookmark"`
+	Done     bool   `json:"done"`
+}
+
+// upgradeV1 rewrites a version 1 sale, decoded into a map, to version 2. The
+// discount of a line is kept, money already has it applied.
+func upgradeV1(doc map[string]interface{}) {
+	if companyID, ok := doc["company_id"].(float64); ok {
+		doc["company_id"] = strconv.FormatFloat(companyID, 'f', -1, 64)
+	}
+	if orderID, ok := doc["order_id"].(string); ok {
+		if n, err := strconv.Atoi(orderID); err == nil {
+			doc["order_id"] = n
+		}
+	}
+	items, _ := doc["items"].([]interface{})
+	for _, it := range items {
+		line, ok := it.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, hasHow := line["how"]; !hasHow {
+			line["how"] = line["f_how"]
+		}
+		delete(line, "f_how")
+		price, hasPrice := line["price"].(float64)
+		how, _ := line["how"].(float64)
+		if _, hasMoney := line["money"]; !hasMoney && hasPrice {
+			line["money"] = price * how
+		}
+		delete(line, "price")
+	}
+}
+
+// decodeSelling unmarshals a stored sale of any schema version.
+func decodeSelling(docAsBytes []byte, s *selling) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(docAsBytes, &doc); err != nil {
+		return err
+	}
+	version, _ := doc["schema_version"].(float64)
+	if int(version) < 2 {
+		upgradeV1(doc)
+	}
+	doc["schema_version"] = schemaVersion
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(upgraded, s); err != nil {
+		return err
+	}
+	// sales from before payments were recorded owe their whole amount
+	if s.Status == "" {
+		s.applyPayment()
+	}
+	return nil
+}
+
+// beforePayments tells a stored sale from before payments were recorded, which
+// is not yet in the open index aging reads.
+func beforePayments(docAsBytes []byte) bool {
+	var stored struct {
+		Status string `json:"status"`
+	}
+	return json.Unmarshal(docAsBytes, &stored) == nil && stored.Status == ""
+}
+
+// putSelling saves a sale read with decodeSelling in the current schema
+// version, first moving the costs of a sale from before private costs into
+// the owner's collection.
+func putSelling(stub shim.ChaincodeStubInterface, key string, s *selling) error {
+	if s.CostCollection == "" {
+		if err := hideCosts(stub, key, s); err != nil {
+			return err
+		}
+	}
+	s.SchemaVersion = schemaVersion
+	saleJSONasBytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, saleJSONasBytes)
+}
+
+// isDocumentKey tells the "<company_id>-<order_id>" keys of sales from
+// the other simple keys of the namespace.
+func isDocumentKey(key string) bool {
+	n := strings.LastIndex(key, "-")
+	if n <= 0 {
+		return false
+	}
+	_, err := strconv.Atoi(key[n+1:])
+	return err == nil
+}
+
+// ============================================================
+// migrate - rewrite sales of older schema versions in the current one,
+// batchSize keys at a time. Pass the returned bookmark to the next call
+// until done.
+// args: batchSize, bookmark ("" to start)
+// ============================================================
+func (t *SellingChaincode) Migrate(ctx contractapi.TransactionContextInterface, batchSize int, bookmark string) (*migration, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start migrate")
+	if batchSize <= 0 {
+		return nil, errors.New("batchSize must be positive")
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, adminRole); err != nil {
+		return nil, errors.New("Only an " + adminRole + " may migrate")
+	}
+
+	resultsIterator, err := stub.GetStateByRange(bookmark, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	m := migration{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if m.Scanned == batchSize {
+			m.Bookmark = response.Key
+			break
+		}
+		m.Scanned++
+		if !isDocumentKey(response.Key) {
+			continue
+		}
+
+		// a sale is current once its costs are private and it has a
+		// payment status
+		var s selling
+		if err := decodeSelling(response.Value, &s); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		unpaid := beforePayments(response.Value)
+		if s.CostCollection != "" && !unpaid {
+			continue
+		}
+		if unpaid {
+			if err := indexOpen(stub, &s); err != nil {
+				return nil, err
+			}
+		}
+		if err := putSelling(stub, response.Key, &s); err != nil {
+			return nil, err
+		}
+		m.Migrated++
+	}
+	m.Done = m.Bookmark == ""
+
+	fmt.Println("- end migrate")
+	return &m, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeSelling(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    selling
+		before  bool
+		wantErr bool
+	}{
+		{
+			name: "version 1 with f_how and price",
+			doc:  `{"company_id":3,"order_id":"7","client":"Org2","acc_time":1,"items":[{"spec_id":1111,"f_how":2,"price":50}]}`,
+			want: selling{SchemaVersion: 3, CompanyID: "3", OrderID: 7, Client: "Org2", AccTime: 1,
+				Items:       []subSelling{{SpecID: 1111, How: 2, Money: 100}},
+				Outstanding: 100, Status: statusUnpaid},
+			before: true,
+		},
+		{
+			name: "version 1 with how and money",
+			doc:  `{"company_id":3,"order_id":7,"client":"Org2","acc_time":1,"items":[{"spec_id":1111,"how":2,"f_how":5,"money":90,"price":50,"discount":10}]}`,
+			want: selling{SchemaVersion: 3, CompanyID: "3", OrderID: 7, Client: "Org2", AccTime: 1,
+				Items:       []subSelling{{SpecID: 1111, How: 2, Money: 90, Discount: 10}},
+				Outstanding: 90, Status: statusUnpaid},
+			before: true,
+		},
+		{
+			name: "version 2 before payments",
+			doc:  `{"schema_version":2,"company_id":"3","order_id":7,"client":"Org2","acc_time":1,"items":[{"spec_id":1111,"how":2,"money":100,"tax":10}],"cogs":60,"margin":40}`,
+			want: selling{SchemaVersion: 3, CompanyID: "3", OrderID: 7, Client: "Org2", AccTime: 1,
+				Items: []subSelling{{SpecID: 1111, How: 2, Money: 100, Tax: 10}}, COGS: 60, Margin: 40,
+				Outstanding: 110, Status: statusUnpaid},
+			before: true,
+		},
+		{
+			name: "version 3 paid",
+			doc:  `{"schema_version":3,"company_id":"3","order_id":7,"client":"Org2","acc_time":1,"items":[{"spec_id":1111,"how":2,"money":100}],"cost_collection":"Org1MSPMargins","paid":100,"outstanding":0,"status":"paid"}`,
+			want: selling{SchemaVersion: 3, CompanyID: "3", OrderID: 7, Client: "Org2", AccTime: 1,
+				Items: []subSelling{{SpecID: 1111, How: 2, Money: 100}}, CostCollection: "Org1MSPMargins",
+				Paid: 100, Status: statusPaid},
+		},
+		{
+			name:    "not JSON",
+			doc:     `3-7`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s selling
+			err := decodeSelling([]byte(tt.doc), &s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("got %+v, want %+v", s, tt.want)
+			}
+			if before := beforePayments([]byte(tt.doc)); before != tt.before {
+				t.Errorf("beforePayments = %v, want %v", before, tt.before)
+			}
+		})
+	}
+}
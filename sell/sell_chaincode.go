@@ -3,30 +3,113 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
-	"github.com/hyperledger/fabric/tree/release-1.1/core/chaincode/shim"
-	pb "github.com/hyperledger/fabric/tree/release-1.1/protos/peer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Names of the other chaincodes, installed on the same channel. Sales are
+// issued from the store's stock, which also costs them, may only reference
+// specs registered in the spec chaincode, are sold to a customer of the
+// party chaincode, are taxed at the rates of the tax chaincode and may not
+// be booked into a period closed in the period chaincode.
+const (
+	storeChaincode  = "store"
+	specChaincode   = "spec"
+	partyChaincode  = "party"
+	taxChaincode    = "tax"
+	periodChaincode = "period"
 )
 
 type SellingChaincode struct {
+	contractapi.Contract
 }
 
+// subSelling is one sold line. DotWeek (WWYY) picks the lot to sell from,
+// otherwise the store takes the oldest lots first. Discount is only
+// recorded, money already has it applied.
 type subSelling struct {
-	SpecID int     `json:"spec_id"`
-	How    int     `json:"how"`
-	Money  float64 `json:"money"`
+	SpecID   int      `json:"spec_id"`
+	How      int      `json:"how"`
+	Money    float64  `json:"money"`
+	DotWeek  string   `json:"dot_week,omitempty" metadata:",optional"`
+	Serials  []string `json:"serials,omitempty" metadata:",optional"`
+	Discount float64  `json:"discount,omitempty" metadata:",optional"`
+	TaxCode  string   `json:"tax_code,omitempty" metadata:",optional"`
+	TaxRate  float64  `json:"tax_rate,omitempty" metadata:",optional"`
+	Tax      float64  `json:"tax" metadata:",optional"`
+	COGS     float64  `json:"cogs" metadata:",optional"`
+	Margin   float64  `json:"margin" metadata:",optional"`
 }
 
+// order_id is left out when the company's sequence allocates it. The tax,
+// costs and payment status are computed; Credited is the quantity credited
+// so far by spec_id.
 type selling struct {
-	CompanyID *string      `json:"company_id"`
-	OrderID   *int         `json:"order_id"`
-	TabNo     string       `json:"tabno"`
-	Client    string       `json:"client"`
-	AccTime   int64        `json:"acc_time"`
-	Items     []subSelling `json:"items"`
+	SchemaVersion int          `json:"schema_version" metadata:",optional"`
+	CompanyID     string       `json:"company_id"`
+	OrderID       int          `json:"order_id" metadata:",optional"`
+	TabNo         string       `json:"tabno" metadata:",optional"`
+	RequestID     string       `json:"request_id,omitempty" metadata:",optional"`
+	Client        string       `json:"client"`
+	AccTime       int64        `json:"acc_time"`
+	Location      string       `json:"location,omitempty" metadata:",optional"`
+	Items         []subSelling `json:"items"`
+	Tax           float64      `json:"tax" metadata:",optional"`
+	COGS          float64      `json:"cogs" metadata:",optional"`
+	Margin        float64      `json:"margin" metadata:",optional"`
+
+	CostCollection string `json:"cost_collection,omitempty" metadata:",optional"`
+	CostHash       string `json:"cost_hash,omitempty" metadata:",optional"`
+
+	Paid           float64        `json:"paid" metadata:",optional"`
+	CreditedAmount float64        `json:"credited_amount" metadata:",optional"`
+	Credited       map[string]int `json:"credited,omitempty" metadata:",optional"`
+	Outstanding    float64        `json:"outstanding" metadata:",optional"`
+	Status         string         `json:"status" metadata:",optional"`
+
+	CreditOverride *creditOverride `json:"credit_override,omitempty" metadata:",optional"`
+}
+
+// stockLine and stockMove are what the store's issue takes for a sale and
+// its receive for the tyres a credit note returns.
+type stockLine struct {
+	SpecID  int      `json:"spec_id"`
+	How     int      `json:"how"`
+	Money   float64  `json:"money"`
+	DotWeek string   `json:"dot_week,omitempty"`
+	Serials []string `json:"serials,omitempty"`
+}
+
+type stockMove struct {
+	CompanyID string      `json:"company_id"`
+	OrderID   int         `json:"order_id"`
+	TabNo     string      `json:"tabno,omitempty"`
+	Client    string      `json:"client"`
+	AccTime   int64       `json:"acc_time"`
+	Location  string      `json:"location,omitempty"`
+	Items     []stockLine `json:"items"`
+}
+
+// issue is the sale as the store issues it from stock.
+func (s *selling) issue() stockMove {
+	m := stockMove{
+		CompanyID: s.CompanyID,
+		OrderID:   s.OrderID,
+		TabNo:     s.TabNo,
+		Client:    s.Client,
+		AccTime:   s.AccTime,
+		Location:  s.Location,
+		Items:     []stockLine{},
+	}
+	for _, l := range s.Items {
+		m.Items = append(m.Items, stockLine{SpecID: l.SpecID, How: l.How, Money: l.Money, DotWeek: l.DotWeek, Serials: l.Serials})
+	}
+	return m
 }
 
 // type index struct {
@@ -38,199 +121,372 @@ type selling struct {
 // Main
 // ===================================================================================
 func main() {
-	err := shim.Start(new(SellingChaincode))
+	chaincode, err := contractapi.NewChaincode(newSellingChaincode())
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
+		fmt.Printf("Error creating sell chaincode: %s", err)
+		return
+	}
+	if err := chaincode.Start(); err != nil {
+		fmt.Printf("Error starting sell chaincode: %s", err)
 	}
 }
 
-// ========================================
-// Init initializes chaincode
-// ===========================
-func (t *SellingChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	return shim.Success(nil)
+func newSellingChaincode() *SellingChaincode {
+	t := new(SellingChaincode)
+	t.Name = "sell"
+	t.Info.Description = "Sales, customer payments and credit notes"
+	t.BeforeTransaction = checkEnabled
+	return t
+}
+
+// GetEvaluateTransactions marks the transactions that only read the ledger,
+// so clients query rather than submit them.
+func (t *SellingChaincode) GetEvaluateTransactions() []string {
+	return []string{
+		"Query", "Documents", "VerifyDocument", "QueryPayment", "Aging",
+		"Balance", "QueryCreditNote", "QueryByTabNo", "QuerySequence",
+		"TaxEntries", "QueryConfig", "RichQuery",
+	}
 }
 
 // ========================================
-// Invoke - Our entry point for Invocations
+// Init initializes chaincode
 // ========================================
-func (t *SellingChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
-	function, args := stub.GetFunctionAndParameters()
-	fmt.Println("invoke is running " + function)
-
-	// Handle different functions
-	if function == "create" { //create a new item
-		return t.create(stub, args)
-	} else if function == "query" {
-		return t.query(stub, args)
+// Instantiate may call init with the first configuration, as an admin.
+// Without a function the contract API succeeds and the stored settings are
+// kept. As init stays callable afterwards, it refuses to replace a
+// configuration; setConfig changes it.
+func (t *SellingChaincode) Init(ctx contractapi.TransactionContextInterface, c config) error {
+	stub := ctx.GetStub()
+	configAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return err
 	}
-
-	fmt.Println("invoke did not find func: " + function) //error
-	return shim.Error("Received unknown function invocation")
+	if configAsBytes != nil {
+		return errors.New("The configuration is already set, use setConfig to change it")
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, adminRole); err != nil {
+		return errors.New("Only an " + adminRole + " may set the configuration")
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	return putConfig(stub, &c)
 }
 
 // ============================================================
 // create - create a new item, store into chaincode state
 // ============================================================
-func (t *SellingChaincode) create(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var err error
+func (t *SellingChaincode) Create(ctx contractapi.TransactionContextInterface, s selling) (*assigned, error) {
+	return t.create(ctx, s, false)
+}
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
-	}
+// CreateOverride creates a sale above the customer's credit limit. Only a
+// manager may.
+func (t *SellingChaincode) CreateOverride(ctx contractapi.TransactionContextInterface, s selling) (*assigned, error) {
+	return t.create(ctx, s, true)
+}
+
+func (t *SellingChaincode) create(ctx contractapi.TransactionContextInterface, s selling, override bool) (*assigned, error) {
+	stub := ctx.GetStub()
+	var err error
 
 	// ==== Input sanitation ====
 	fmt.Println("- start create item")
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+	if s.CompanyID == "" {
+		return nil, errors.New("company_id must be required")
 	}
-
-	var s selling
-	itemJSONasBytes := []byte(args[0])
-	if err := json.Unmarshal(itemJSONasBytes, &s); err != nil {
-		msg := fmt.Sprintf("Invalid json format - %s", args[0])
-		return shim.Error(msg)
+	if err := checkCompany(stub, s.CompanyID); err != nil {
+		return nil, err
+	}
+	// ==== A retried request returns its original result ====
+	var hash string
+	if s.RequestID != "" {
+		hashed := []string{}
+		if override {
+			hashed = append(hashed, "override")
+		}
+		hash, err = payloadHash(stub, hashed...)
+		if err != nil {
+			return nil, err
+		}
+		result, err := replayRequest(stub, s.CompanyID, s.RequestID, hash)
+		if err != nil {
+			return nil, err
+		}
+		if result != nil {
+			fmt.Println("- replay create item " + s.RequestID)
+			return result, nil
+		}
+	}
+	tabNo, err := nextNumber(stub, s.CompanyID, "sale", s.AccTime, "order_id", &s.OrderID)
+	if err != nil {
+		return nil, err
 	}
-	if s.CompanyID == nil {
-		return shim.Error("company_id must be required")
+	if tabNo != "" {
+		s.TabNo = tabNo
 	}
-	if s.OrderID == nil {
-		return shim.Error("order_id must be required")
+	if err := checkPeriod(stub, s.CompanyID, s.AccTime); err != nil {
+		return nil, err
 	}
-	key := fmt.Sprintf("%s-%s", *s.CompanyID, strconv.Itoa(*s.OrderID))
+	specIDs := []string{}
+	for _, line := range s.Items {
+		specIDs = append(specIDs, strconv.Itoa(line.SpecID))
+	}
+	if err := checkSpecs(stub, specIDs); err != nil {
+		return nil, err
+	}
+	if err := checkParty(stub, s.Client, "customer"); err != nil {
+		return nil, err
+	}
+	entry, err := computeTax(stub, &s)
+	if err != nil {
+		return nil, err
+	}
+	s.CreditOverride, err = checkCredit(stub, s.Client, s.amount(), override)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s-%s", s.CompanyID, strconv.Itoa(s.OrderID))
 
 	// ==== Check if item already exists ====
 	itemAsBytes, err := stub.GetState(key)
 	if err != nil {
-		return shim.Error("Failed to get item: " + err.Error())
+		return nil, errors.New("Failed to get item: " + err.Error())
 	} else if itemAsBytes != nil {
 		msg := fmt.Sprintf("The key %s has already existed!", key)
-		return shim.Error(msg)
+		return nil, errors.New(msg)
+	}
+	if err := indexTabNo(stub, s.CompanyID, s.TabNo, strconv.Itoa(s.OrderID)); err != nil {
+		return nil, err
+	}
+
+	// ==== Issue the lines from stock and keep their cost ====
+	// the sale as numbered, not as passed in
+	issueJSONasBytes, err := json.Marshal(s.issue())
+	if err != nil {
+		return nil, err
+	}
+	response := stub.InvokeChaincode(storeChaincode, [][]byte{[]byte("issue"), issueJSONasBytes}, "")
+	if response.Status != shim.OK {
+		return nil, errors.New("Failed to issue from store: " + response.Message)
+	}
+	var costed selling
+	if err := json.Unmarshal(response.Payload, &costed); err != nil || len(costed.Items) != len(s.Items) {
+		return nil, errors.New("Invalid costing returned by store")
+	}
+	for i := range s.Items {
+		s.Items[i].COGS = costed.Items[i].COGS
+		s.Items[i].Margin = costed.Items[i].Margin
+	}
+	s.COGS = costed.COGS
+	s.Margin = costed.Margin
+
+	if err := addReceivable(stub, s.Client, s.CompanyID, s.amount()); err != nil {
+		return nil, err
+	}
+	s.SchemaVersion = schemaVersion
+	s.Paid = 0
+	s.CreditedAmount = 0
+	s.Credited = nil
+	s.applyPayment()
+	if err := indexOpen(stub, &s); err != nil {
+		return nil, err
+	}
+	if err := putTaxEntry(stub, entry); err != nil {
+		return nil, err
+	}
+	if err := hideCosts(stub, key, &s); err != nil {
+		return nil, err
+	}
+
+	itemJSONasBytes, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
 	}
 
 	// === Save item to state ===
 	err = stub.PutState(key, itemJSONasBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
+	}
+	if err := endorseByOwner(stub, s.CompanyID, key); err != nil {
+		return nil, err
 	}
 
-	// ==== Item saved and indexed. Return success ====
+	// ==== Item saved and indexed. Return the assigned key ====
+	result := assigned{Key: key, OrderID: s.OrderID, TabNo: s.TabNo}
+	if s.RequestID != "" {
+		if err := recordRequest(stub, s.CompanyID, s.RequestID, hash, &result); err != nil {
+			return nil, err
+		}
+	}
 	fmt.Println("- end create item")
-	return shim.Success(nil)
+	return &result, nil
+}
+
+// checkSpecs fails unless every spec_id is registered in the spec chaincode
+// and has not been discontinued.
+func checkSpecs(stub shim.ChaincodeStubInterface, specIDs []string) error {
+	specIDsAsBytes, err := json.Marshal(specIDs)
+	if err != nil {
+		return err
+	}
+	args := [][]byte{[]byte("check"), specIDsAsBytes}
+	response := stub.InvokeChaincode(specChaincode, args, "")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// checkParty fails unless client is an active party of the party chaincode
+// that may act in role.
+func checkParty(stub shim.ChaincodeStubInterface, client string, role string) error {
+	args := [][]byte{[]byte("check"), []byte(client), []byte(role)}
+	response := stub.InvokeChaincode(partyChaincode, args, "")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// checkPeriod fails if accTime falls in a period of the company that the
+// period chaincode has closed.
+func checkPeriod(stub shim.ChaincodeStubInterface, companyID string, accTime int64) error {
+	args := [][]byte{[]byte("check"), []byte(companyID), []byte(strconv.FormatInt(accTime, 10))}
+	response := stub.InvokeChaincode(periodChaincode, args, "")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
 }
 
 // ============================================================
 // Modify - modify a item, store into chaincode state
 // ============================================================
-func (t *SellingChaincode) modifyClient(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *SellingChaincode) ModifyClient(ctx contractapi.TransactionContextInterface, companyID string, id string, client string) error {
+	stub := ctx.GetStub()
 	var err error
 
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
-	}
-
 	// ==== Input sanitation ====
 	fmt.Println("- start modify item")
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+	if len(companyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
 	}
-	if len(args[1]) <= 0 {
-		return shim.Error("2nd argument must be a non-empty string")
+	if len(id) <= 0 {
+		return errors.New("2nd argument must be a non-empty string")
 	}
-	if len(args[2]) <= 0 {
-		return shim.Error("3nd argument must be a non-empty string")
+	if len(client) <= 0 {
+		return errors.New("3nd argument must be a non-empty string")
 	}
 
-	companyID := args[0]
-	id := args[1]
-	client := args[2]
 	key := fmt.Sprintf("%s-%s", companyID, id)
 
+	if err := checkParty(stub, client, "customer"); err != nil {
+		return err
+	}
+
 	// ==== Check if item already exists ====
 	itemAsBytes, err := stub.GetState(key)
 	if err != nil {
-		return shim.Error("Failed to get item: " + err.Error())
+		return errors.New("Failed to get item: " + err.Error())
 	} else if itemAsBytes == nil {
 		fmt.Println("This item NOT exists: " + id)
-		return shim.Error("This item NOT exists: " + id)
+		return errors.New("This item NOT exists: " + id)
 	}
 
 	s := selling{}
-	err = json.Unmarshal(itemAsBytes, &s)
+	err = decodeSelling(itemAsBytes, &s)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
+	}
+	if err := checkPeriod(stub, companyID, s.AccTime); err != nil {
+		return err
 	}
-	s.Client = client
 
-	itemJSONasBytes, err := json.Marshal(s)
-	if err != nil {
-		return shim.Error(err.Error())
+	// ==== Move the receivable to the new client ====
+	if s.Client != client {
+		if s.Paid > 0 {
+			return errors.New("The sale " + key + " has payments from " + s.Client)
+		}
+		if _, err := checkCredit(stub, client, s.Outstanding, false); err != nil {
+			return err
+		}
+		if err := addReceivable(stub, s.Client, s.CompanyID, -s.Outstanding); err != nil {
+			return err
+		}
+		if err := addReceivable(stub, client, s.CompanyID, s.Outstanding); err != nil {
+			return err
+		}
+		oldOpenKey, err := openKey(stub, &s)
+		if err != nil {
+			return err
+		}
+		if err := stub.DelState(oldOpenKey); err != nil {
+			return err
+		}
+	}
+	s.Client = client
+	if err := indexOpen(stub, &s); err != nil {
+		return err
 	}
 
 	// === Save item to state ===
-	err = stub.PutState(key, itemJSONasBytes)
-	if err != nil {
-		return shim.Error(err.Error())
+	if err := putSelling(stub, key, &s); err != nil {
+		return err
 	}
 
 	// ==== Item saved and indexed. Return success ====
 	fmt.Println("- end modify item")
-	return shim.Success(nil)
+	return nil
 }
 
 // ==================================================
 // delete - remove a item from state
 // ==================================================
-func (t *SellingChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *SellingChaincode) delete(ctx contractapi.TransactionContextInterface, companyID string, id string) error {
+	stub := ctx.GetStub()
 	var jsonResp string
 	var itemJSON selling
 
 	fmt.Println("- start delete item")
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-
-	companyID := args[0]
-	id := args[1]
 	key := fmt.Sprintf("%s-%s", companyID, id)
 
 	itemAsbytes, err := stub.GetState(key) //get the item from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return errors.New(jsonResp)
 	} else if itemAsbytes == nil {
 		jsonResp = "{\"Error\":\"Item does not exist: " + key + "\"}"
-		return shim.Error(jsonResp)
+		return errors.New(jsonResp)
 	}
 
 	err = json.Unmarshal([]byte(itemAsbytes), &itemJSON)
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to decode JSON of: " + key + "\"}"
-		return shim.Error(jsonResp)
+		return errors.New(jsonResp)
 	}
 
 	err = stub.DelState(key) //remove the item from chaincode state
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return errors.New("Failed to delete state:" + err.Error())
 	}
 
 	fmt.Println("- end delete item")
-	return shim.Success(nil)
+	return nil
 }
 
 // ==================================================
 // query - query a item by id
 // ==================================================
-func (t *SellingChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *SellingChaincode) Query(ctx contractapi.TransactionContextInterface, key string) (*selling, error) {
+	stub := ctx.GetStub()
 
 	fmt.Println("- start query item")
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
-	}
-
 	// ==== Input sanitation ====
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
+	if len(key) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
 	}
 
 	// var idx index
@@ -240,42 +496,43 @@ func (t *SellingChaincode) query(stub shim.ChaincodeStubInterface, args []string
 	// 	return shim.Error(msg)
 	// }
 	// key := fmt.Sprintf("%s-%s", idx.CompanyID, strconv.Itoa(idx.OrderID))
-	key := args[0]
 
 	// Get the state from the ledger
 	itemAsbytes, err := stub.GetState(key)
 	if err != nil {
 		jsonResp := "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return nil, errors.New(jsonResp)
 	}
 
 	if itemAsbytes == nil {
 		jsonResp := "{\"Error\":\"Nil selling for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return nil, errors.New(jsonResp)
 	}
 
-	fmt.Printf("Query Response:%s\n", string(itemAsbytes[:]))
+	// ==== Return sales of older schema versions in the current one ====
+	var s selling
+	if err := decodeSelling(itemAsbytes, &s); err != nil {
+		return nil, errors.New("Failed to decode JSON of: " + key)
+	}
+	if _, err := revealCosts(stub, key, &s); err != nil {
+		return nil, err
+	}
 
 	fmt.Println("- end query item")
-	return shim.Success(itemAsbytes)
+	return &s, nil
 }
 
-func (t *SellingChaincode) getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *SellingChaincode) getHistory(ctx contractapi.TransactionContextInterface, companyID string, id string) (string, error) {
+	stub := ctx.GetStub()
 	fmt.Println("- start getHistory item")
 
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-
-	companyID := args[0]
-	id := args[1]
 	key := fmt.Sprintf("%s-%s", companyID, id)
 
 	fmt.Printf("- start getHistory: %s\n", key)
 
 	resultsIterator, err := stub.GetHistoryForKey(key)
 	if err != nil {
-		return shim.Error(err.Error())
+		return "", err
 	}
 	defer resultsIterator.Close()
 
@@ -287,7 +544,7 @@ func (t *SellingChaincode) getHistory(stub shim.ChaincodeStubInterface, args []s
 	for resultsIterator.HasNext() {
 		response, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return "", err
 		}
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
@@ -326,5 +583,5 @@ func (t *SellingChaincode) getHistory(stub shim.ChaincodeStubInterface, args []s
 	fmt.Printf("- getHistoryForSelling returning:\n%s\n", buffer.String())
 
 	fmt.Println("- end getHistory item")
-	return shim.Success(buffer.Bytes())
+	return string(buffer.Bytes()), nil
 }
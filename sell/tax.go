@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// taxLine and taxEntry are the output tax of one sale or credit note, read
+// by the tax chaincode's taxReport. Credit notes carry negative amounts.
+type taxLine struct {
+	TaxCode string  `json:"tax_code"`
+	Rate    float64 `json:"rate"`
+	Base    float64 `json:"base"`
+	Tax     float64 `json:"tax"`
+}
+
+type taxEntry struct {
+	CompanyID string    `json:"company_id"`
+	DocType   string    `json:"doc_type"`
+	DocID     string    `json:"doc_id"`
+	AccTime   int64     `json:"acc_time"`
+	Lines     []taxLine `json:"lines"`
+}
+
+// resolveTax asks the tax chaincode for the rates of codes in effect on the
+// (UTC) day of accTime.
+func resolveTax(stub shim.ChaincodeStubInterface, accTime int64, codes []string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	if len(codes) == 0 {
+		return rates, nil
+	}
+	codesAsBytes, err := json.Marshal(codes)
+	if err != nil {
+		return nil, err
+	}
+	args := [][]byte{[]byte("resolve"), []byte(time.Unix(accTime, 0).UTC().Format("20060102")), codesAsBytes}
+	response := stub.InvokeChaincode(taxChaincode, args, "")
+	if response.Status != shim.OK {
+		return nil, errors.New(response.Message)
+	}
+	if err := json.Unmarshal(response.Payload, &rates); err != nil {
+		return nil, fmt.Errorf("Invalid rates returned by tax")
+	}
+	return rates, nil
+}
+
+// computeTax sets the output tax of each line with a tax_code and returns
+// the entry for the tax report. Lines without a tax_code are not taxed.
+func computeTax(stub shim.ChaincodeStubInterface, s *selling) (*taxEntry, error) {
+	codes := []string{}
+	for _, l := range s.Items {
+		if l.TaxCode != "" {
+			codes = append(codes, l.TaxCode)
+		}
+	}
+	rates, err := resolveTax(stub, s.AccTime, codes)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &taxEntry{
+		CompanyID: s.CompanyID,
+		DocType:   "sale",
+		DocID:     strconv.Itoa(s.OrderID),
+		AccTime:   s.AccTime,
+		Lines:     []taxLine{},
+	}
+	s.Tax = 0
+	for i := range s.Items {
+		l := &s.Items[i]
+		l.TaxRate = 0
+		l.Tax = 0
+		if l.TaxCode == "" {
+			continue
+		}
+		l.TaxRate = rates[l.TaxCode]
+		l.Tax = round2(l.Money * l.TaxRate / 100)
+		s.Tax += l.Tax
+		entry.Lines = append(entry.Lines, taxLine{TaxCode: l.TaxCode, Rate: l.TaxRate, Base: l.Money, Tax: l.Tax})
+	}
+	s.Tax = round2(s.Tax)
+	return entry, nil
+}
+
+func putTaxEntry(stub shim.ChaincodeStubInterface, entry *taxEntry) error {
+	key, err := stub.CreateCompositeKey("tax", []string{entry.CompanyID, entry.DocType, entry.DocID})
+	if err != nil {
+		return err
+	}
+	entryJSONasBytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return putByOwner(stub, entry.CompanyID, key, entryJSONasBytes)
+}
+
+// ==================================================
+// taxEntries - output tax entries of a company with from <= acc_time < to
+// ==================================================
+func (t *SellingChaincode) TaxEntries(ctx contractapi.TransactionContextInterface, companyID string, from int64, to int64) ([]taxEntry, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start taxEntries")
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("tax", []string{companyID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	entries := []taxEntry{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var entry taxEntry
+		if err := json.Unmarshal(response.Value, &entry); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		if entry.AccTime >= from && entry.AccTime < to {
+			entries = append(entries, entry)
+		}
+	}
+
+	fmt.Println("- end taxEntries")
+	return entries, nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Only callers whose certificate carries role=manager may create, change or
+// discontinue specs.
+const (
+	roleAttribute = "role"
+	managerRole   = "manager"
+)
+
+type SpecChaincode struct {
+	contractapi.Contract
+}
+
+// spec is one tyre product, referenced by spec_id from purchases, sales and
+// store items.
+type spec struct {
+	SpecID       int    `json:"spec_id"`
+	Brand        string `json:"brand"`
+	Pattern      string `json:"pattern" metadata:",optional"`
+	Size         string `json:"size"`
+	LoadIndex    string `json:"load_index" metadata:",optional"`
+	SpeedRating  string `json:"speed_rating" metadata:",optional"`
+	Season       string `json:"season" metadata:",optional"`
+	EAN          string `json:"ean" metadata:",optional"`
+	Discontinued bool   `json:"discontinued" metadata:",optional"`
+}
+
+// specHistory is one change of a spec, Value is left out for a delete.
+type specHistory struct {
+	TxId      string `json:"TxId"`
+	Value     *spec  `json:"Value,omitempty" metadata:",optional"`
+	Timestamp string `json:"Timestamp"`
+	IsDelete  bool   `json:"IsDelete"`
+}
+
+var seasons = map[string]bool{
+	"":           true,
+	"summer":     true,
+	"winter":     true,
+	"all-season": true,
+}
+
+// description renders a spec the way it is printed on the sidewall,
+// e.g. "Michelin Primacy 4 205/55R16 91V".
+func (s *spec) description() string {
+	parts := []string{}
+	for _, p := range []string{s.Brand, s.Pattern, s.Size, s.LoadIndex + s.SpeedRating} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *spec) validate() error {
+	if s.SpecID <= 0 {
+		return fmt.Errorf("spec_id must be required")
+	}
+	if s.Brand == "" {
+		return fmt.Errorf("brand must be required")
+	}
+	if s.Size == "" {
+		return fmt.Errorf("size must be required")
+	}
+	if !seasons[s.Season] {
+		return fmt.Errorf("season must be summer, winter or all-season")
+	}
+	return nil
+}
+
+// ===================================================================================
+// Main
+// ===================================================================================
+func main() {
+	chaincode, err := contractapi.NewChaincode(newSpecChaincode())
+	if err != nil {
+		fmt.Printf("Error creating spec chaincode: %s", err)
+		return
+	}
+	if err := chaincode.Start(); err != nil {
+		fmt.Printf("Error starting spec chaincode: %s", err)
+	}
+}
+
+func newSpecChaincode() *SpecChaincode {
+	t := new(SpecChaincode)
+	t.Name = "spec"
+	t.Info.Description = "Tyre specs referenced by purchases, sales and stock"
+	return t
+}
+
+// GetEvaluateTransactions marks the transactions that only read the ledger,
+// so clients query rather than submit them.
+func (t *SpecChaincode) GetEvaluateTransactions() []string {
+	return []string{"Query", "Check", "Describe", "GetHistory"}
+}
+
+// ============================================================
+// create - register a new spec, store into chaincode state
+// ============================================================
+func (t *SpecChaincode) Create(ctx contractapi.TransactionContextInterface, s spec) error {
+	stub := ctx.GetStub()
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a manager may create a spec: " + err.Error())
+	}
+
+	// ==== Input sanitation ====
+	fmt.Println("- start create spec")
+	if err := s.validate(); err != nil {
+		return err
+	}
+	s.Discontinued = false
+	key := strconv.Itoa(s.SpecID)
+
+	// ==== Check if spec already exists ====
+	specAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errors.New("Failed to get spec: " + err.Error())
+	} else if specAsBytes != nil {
+		return fmt.Errorf("The key %s has already existed!", key)
+	}
+
+	// === Save spec to state ===
+	if err := putSpec(stub, &s); err != nil {
+		return err
+	}
+
+	fmt.Println("- end create spec")
+	return nil
+}
+
+// ============================================================
+// update - replace the description of an existing spec
+// ============================================================
+func (t *SpecChaincode) Update(ctx contractapi.TransactionContextInterface, s spec) error {
+	stub := ctx.GetStub()
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a manager may update a spec: " + err.Error())
+	}
+
+	// ==== Input sanitation ====
+	fmt.Println("- start update spec")
+	if err := s.validate(); err != nil {
+		return err
+	}
+
+	old, err := getSpec(stub, strconv.Itoa(s.SpecID))
+	if err != nil {
+		return err
+	}
+	// discontinue is the only way to change the status
+	s.Discontinued = old.Discontinued
+
+	if err := putSpec(stub, &s); err != nil {
+		return err
+	}
+
+	fmt.Println("- end update spec")
+	return nil
+}
+
+// ============================================================
+// discontinue - stop a spec from being bought or sold
+// ============================================================
+func (t *SpecChaincode) Discontinue(ctx contractapi.TransactionContextInterface, specID string) error {
+	stub := ctx.GetStub()
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a manager may discontinue a spec: " + err.Error())
+	}
+
+	// ==== Input sanitation ====
+	fmt.Println("- start discontinue spec")
+	if len(specID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
+	}
+
+	s, err := getSpec(stub, specID)
+	if err != nil {
+		return err
+	}
+	s.Discontinued = true
+
+	if err := putSpec(stub, s); err != nil {
+		return err
+	}
+
+	fmt.Println("- end discontinue spec")
+	return nil
+}
+
+// ==================================================
+// query - query a spec by spec_id
+// ==================================================
+func (t *SpecChaincode) Query(ctx contractapi.TransactionContextInterface, specID string) (*spec, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start query spec")
+
+	// ==== Input sanitation ====
+	if len(specID) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	specAsbytes, err := stub.GetState(specID)
+	if err != nil {
+		jsonResp := "{\"Error\":\"Failed to get state for " + specID + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	if specAsbytes == nil {
+		jsonResp := "{\"Error\":\"Nil spec for " + specID + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	var s spec
+	if err := json.Unmarshal(specAsbytes, &s); err != nil {
+		return nil, errors.New("Failed to decode JSON of: " + specID)
+	}
+
+	fmt.Println("- end query spec")
+	return &s, nil
+}
+
+// ==================================================
+// check - fail unless every spec_id is registered and not discontinued
+// ==================================================
+func (t *SpecChaincode) Check(ctx contractapi.TransactionContextInterface, specIDs []string) error {
+	stub := ctx.GetStub()
+	fmt.Println("- start check spec")
+
+	for _, specID := range specIDs {
+		s, err := getSpec(stub, specID)
+		if err != nil {
+			return err
+		}
+		if s.Discontinued {
+			return errors.New("The spec " + specID + " has been discontinued")
+		}
+	}
+
+	fmt.Println("- end check spec")
+	return nil
+}
+
+// ==================================================
+// describe - map of spec_id to tyre description, for reports
+// ==================================================
+func (t *SpecChaincode) Describe(ctx contractapi.TransactionContextInterface, specIDs []string) (map[string]string, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start describe spec")
+
+	descriptions := map[string]string{}
+	for _, specID := range specIDs {
+		specAsBytes, err := stub.GetState(specID)
+		if err != nil {
+			return nil, err
+		}
+		if specAsBytes == nil {
+			// unknown specs are left out rather than failing a report
+			continue
+		}
+		var s spec
+		if err := json.Unmarshal(specAsBytes, &s); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + specID)
+		}
+		descriptions[specID] = s.description()
+	}
+
+	fmt.Println("- end describe spec")
+	return descriptions, nil
+}
+
+func getSpec(stub shim.ChaincodeStubInterface, specID string) (*spec, error) {
+	specAsBytes, err := stub.GetState(specID)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get spec: %s", err.Error())
+	} else if specAsBytes == nil {
+		return nil, fmt.Errorf("Unknown spec_id: %s", specID)
+	}
+	var s spec
+	if err := json.Unmarshal(specAsBytes, &s); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", specID)
+	}
+	return &s, nil
+}
+
+func putSpec(stub shim.ChaincodeStubInterface, s *spec) error {
+	specJSONasBytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(strconv.Itoa(s.SpecID), specJSONasBytes)
+}
+
+func (t *SpecChaincode) GetHistory(ctx contractapi.TransactionContextInterface, specID string) ([]specHistory, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start getHistory spec")
+
+	fmt.Printf("- start getHistory: %s\n", specID)
+
+	resultsIterator, err := stub.GetHistoryForKey(specID)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	history := []specHistory{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		h := specHistory{
+			TxId:      response.TxId,
+			Timestamp: time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String(),
+			IsDelete:  response.IsDelete,
+		}
+		if !response.IsDelete {
+			h.Value = &spec{}
+			if err := json.Unmarshal(response.Value, h.Value); err != nil {
+				return nil, errors.New("Failed to decode JSON of: " + specID)
+			}
+		}
+		history = append(history, h)
+	}
+
+	fmt.Println("- end getHistory spec")
+	return history, nil
+}
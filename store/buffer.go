@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+)
+
+// txStub lets a transaction read its own writes. GetState, GetPrivateData
+// and range scans of the peer only see the state before the transaction, so
+// a receipt, sale or adjustment listing the same spec, lot or serial twice
+// would otherwise overwrite its earlier lines. Writes still go to the peer at
+// once; the last write of a key is the one committed.
+type txStub struct {
+	shim.ChaincodeStubInterface
+	// written holds the values put by this transaction by collection, ""
+	// for public state, with nil for deleted keys
+	written map[string]map[string][]byte
+}
+
+func newTxStub(stub shim.ChaincodeStubInterface) *txStub {
+	return &txStub{ChaincodeStubInterface: stub, written: map[string]map[string][]byte{}}
+}
+
+func (s *txStub) record(collection string, key string, value []byte) {
+	if s.written[collection] == nil {
+		s.written[collection] = map[string][]byte{}
+	}
+	s.written[collection][key] = value
+}
+
+func (s *txStub) GetState(key string) ([]byte, error) {
+	if value, ok := s.written[""][key]; ok {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetState(key)
+}
+
+func (s *txStub) PutState(key string, value []byte) error {
+	if err := s.ChaincodeStubInterface.PutState(key, value); err != nil {
+		return err
+	}
+	s.record("", key, value)
+	return nil
+}
+
+func (s *txStub) DelState(key string) error {
+	if err := s.ChaincodeStubInterface.DelState(key); err != nil {
+		return err
+	}
+	s.record("", key, nil)
+	return nil
+}
+
+func (s *txStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	if value, ok := s.written[collection][key]; ok {
+		return value, nil
+	}
+	return s.ChaincodeStubInterface.GetPrivateData(collection, key)
+}
+
+func (s *txStub) PutPrivateData(collection string, key string, value []byte) error {
+	if err := s.ChaincodeStubInterface.PutPrivateData(collection, key, value); err != nil {
+		return err
+	}
+	s.record(collection, key, value)
+	return nil
+}
+
+func (s *txStub) DelPrivateData(collection string, key string) error {
+	if err := s.ChaincodeStubInterface.DelPrivateData(collection, key); err != nil {
+		return err
+	}
+	s.record(collection, key, nil)
+	return nil
+}
+
+// GetStateByPartialCompositeKey merges the keys written by this transaction
+// into the scan, keeping the composite key order.
+func (s *txStub) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	resultsIterator, err := s.ChaincodeStubInterface.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return s.merge("", objectType, attributes, resultsIterator)
+}
+
+func (s *txStub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	resultsIterator, err := s.ChaincodeStubInterface.GetPrivateDataByPartialCompositeKey(collection, objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return s.merge(collection, objectType, attributes, resultsIterator)
+}
+
+func (s *txStub) merge(collection string, objectType string, attributes []string, resultsIterator shim.StateQueryIteratorInterface) (shim.StateQueryIteratorInterface, error) {
+	defer resultsIterator.Close()
+	prefix, err := s.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string][]byte{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		values[response.Key] = response.Value
+	}
+	for key, value := range s.written[collection] {
+		if strings.HasPrefix(key, prefix) {
+			values[key] = value
+		}
+	}
+
+	results := &kvIterator{}
+	for key, value := range values {
+		if value != nil {
+			results.kvs = append(results.kvs, &queryresult.KV{Key: key, Value: value})
+		}
+	}
+	sort.Slice(results.kvs, func(a, b int) bool { return results.kvs[a].Key < results.kvs[b].Key })
+	return results, nil
+}
+
+// kvIterator iterates over results already read into memory.
+type kvIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (it *kvIterator) HasNext() bool {
+	return len(it.kvs) > 0
+}
+
+func (it *kvIterator) Next() (*queryresult.KV, error) {
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+func (it *kvIterator) Close() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// defaultLocation receives purchases and ships sales that do not name a
+// location, and holds stock booked before locations existed.
+const defaultLocation = "main"
+
+func locationOrDefault(location string) string {
+	if location == "" {
+		return defaultLocation
+	}
+	return location
+}
+
+// normalizeLocations puts stock that is not assigned to any location into
+// the default location, so the locations always add up to how3.
+func (i *item) normalizeLocations() {
+	if i.Locations == nil {
+		i.Locations = map[string]int{}
+	}
+	assigned := 0
+	for location, how := range i.Locations {
+		if location != defaultLocation {
+			assigned += how
+		}
+	}
+	if rest := i.How3 - assigned; rest != 0 || i.Locations[defaultLocation] != 0 {
+		i.Locations[defaultLocation] = rest
+	}
+	for location, how := range i.Locations {
+		if how == 0 {
+			delete(i.Locations, location)
+		}
+	}
+}
+
+// addLocation changes the stock of an item at one location by how, keeping
+// how3 as the total.
+func (i *item) addLocation(location string, how int) error {
+	i.normalizeLocations()
+	if i.Locations[location]+how < 0 {
+		return fmt.Errorf("Insufficient stock of %s-%s at %s: %d on hand, %d requested", i.CompanyID, i.SpecID, location, i.Locations[location], -how)
+	}
+	i.Locations[location] += how
+	i.How3 += how
+	i.normalizeLocations()
+	return nil
+}
+
+// ============================================================
+// move - move stock between locations of a company
+// ============================================================
+func (t *ItemChaincode) Move(ctx contractapi.TransactionContextInterface, companyID string, specID string, from string, to string, how int) error {
+	stub := ctx.GetStub()
+	// ==== Input sanitation ====
+	fmt.Println("- start move")
+	for n, arg := range []string{companyID, specID, from, to} {
+		if len(arg) <= 0 {
+			return fmt.Errorf("argument %d must be a non-empty string", n+1)
+		}
+	}
+	if how <= 0 {
+		return errors.New("5th argument must be positive")
+	}
+	if from == to {
+		return errors.New("from and to must be different locations")
+	}
+	if err := checkPeriodNow(stub, companyID); err != nil {
+		return err
+	}
+
+	i, err := getItem(stub, companyID, specID)
+	if err != nil {
+		return err
+	}
+	if err := i.addLocation(from, -how); err != nil {
+		return err
+	}
+	if err := i.addLocation(to, how); err != nil {
+		return err
+	}
+	if err := putItem(stub, i); err != nil {
+		return err
+	}
+
+	fmt.Println("- end move")
+	return nil
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// unknownWeek is the lot of tyres received without a DOT week. It sorts
+// after every real week so known old stock is sold first.
+const unknownWeek = "9999"
+
+// lot is the stock of one spec in a company produced in one DOT week.
+type lot struct {
+	CompanyID string `json:"company_id"`
+	SpecID    string `json:"spec_id"`
+	DotWeek   string `json:"dot_week"`
+	How       int    `json:"how"`
+}
+
+// lotSale is the tyres of one DOT week a sale took out of the lots of a
+// spec without naming serials, so that a recall can find who bought them.
+type lotSale struct {
+	CompanyID string `json:"company_id"`
+	OrderID   int    `json:"order_id"`
+	Client    string `json:"client"`
+	SpecID    string `json:"spec_id"`
+	DotWeek   string `json:"dot_week"`
+	How       int    `json:"how"`
+	AccTime   int64  `json:"acc_time"`
+}
+
+type lotAge struct {
+	SpecID   string `json:"spec_id"`
+	DotWeek  string `json:"dot_week"`
+	How      int    `json:"how"`
+	AgeWeeks int    `json:"age_weeks"`
+}
+
+type stockAgeing struct {
+	CompanyID string         `json:"company_id"`
+	Buckets   map[string]int `json:"buckets"`
+	Lots      []lotAge       `json:"lots"`
+}
+
+// ageBuckets are whole years on the shelf; tyres past six years should not
+// be sold as new.
+var ageBuckets = []string{"0-1", "1-2", "2-3", "3-4", "4-5", "5-6", "6+"}
+
+// lotWeek is the YYWW key of a DOT week "WWYY", or unknownWeek for "".
+func lotWeek(dotWeekWWYY string) (string, error) {
+	if dotWeekWWYY == "" {
+		return unknownWeek, nil
+	}
+	week, err := dotWeek(dotWeekWWYY)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%04d", week), nil
+}
+
+// lotDotWeek turns a lot key back into the WWYY written on the tyre.
+func lotDotWeek(week string) string {
+	if week == unknownWeek {
+		return ""
+	}
+	return week[2:] + week[:2]
+}
+
+// productionTime is the first day of a YYWW production week.
+func productionTime(week string) time.Time {
+	yyww, _ := strconv.Atoi(week)
+	return time.Date(2000+yyww/100, time.January, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, (yyww%100-1)*7)
+}
+
+func lotKey(stub shim.ChaincodeStubInterface, companyID string, specID string, week string) (string, error) {
+	return stub.CreateCompositeKey("lot", []string{companyID, specID, week})
+}
+
+// addLot changes the quantity of a lot by how, deleting it when empty.
+func addLot(stub shim.ChaincodeStubInterface, companyID string, specID string, week string, how int) error {
+	key, err := lotKey(stub, companyID, specID, week)
+	if err != nil {
+		return err
+	}
+	lotAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return err
+	}
+	l := lot{CompanyID: companyID, SpecID: specID, DotWeek: lotDotWeek(week)}
+	if lotAsBytes != nil {
+		if err := json.Unmarshal(lotAsBytes, &l); err != nil {
+			return fmt.Errorf("Failed to decode JSON of lot: %s-%s-%s", companyID, specID, week)
+		}
+	}
+	l.How += how
+	if l.How < 0 {
+		return fmt.Errorf("Lot %s of %s-%s has only %d in stock", lotDotWeek(week), companyID, specID, l.How-how)
+	}
+	if l.How == 0 {
+		return stub.DelState(key)
+	}
+	lotJSONasBytes, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return putByOwner(stub, companyID, key, lotJSONasBytes)
+}
+
+// receiveLots books a purchase line into lots, by the week of each serial
+// when serials are given and by the line's dot_week otherwise.
+func receiveLots(stub shim.ChaincodeStubInterface, companyID string, line *subPurchase) error {
+	specID := strconv.Itoa(line.SpecID)
+	if len(line.Serials) > 0 {
+		for _, serial := range line.Serials {
+			week := unknownWeek
+			if w, ok := serialWeek(serial); ok {
+				week = fmt.Sprintf("%04d", w)
+			}
+			if err := addLot(stub, companyID, specID, week, 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	week, err := lotWeek(line.DotWeek)
+	if err != nil {
+		return err
+	}
+	return addLot(stub, companyID, specID, week, line.How)
+}
+
+// issueLots takes a sale line out of lots: the lots of its serials, the lot
+// picked by dot_week, or else the oldest lots first. It returns what it took
+// from lots other than by serial, serials being traced on their own.
+func issueLots(stub shim.ChaincodeStubInterface, companyID string, line *subSelling) ([]lot, error) {
+	specID := strconv.Itoa(line.SpecID)
+	if len(line.Serials) > 0 {
+		for _, serial := range line.Serials {
+			week := unknownWeek
+			if w, ok := serialWeek(serial); ok {
+				week = fmt.Sprintf("%04d", w)
+			}
+			if err := addLot(stub, companyID, specID, week, -1); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+	if line.DotWeek != "" {
+		week, err := lotWeek(line.DotWeek)
+		if err != nil {
+			return nil, err
+		}
+		if err := addLot(stub, companyID, specID, week, -line.How); err != nil {
+			return nil, err
+		}
+		return []lot{{CompanyID: companyID, SpecID: specID, DotWeek: lotDotWeek(week), How: line.How}}, nil
+	}
+	return takeLots(stub, companyID, specID, line.How)
+}
+
+// takeLots takes how tyres off the lots of a spec, oldest first, and returns
+// how many it took from each. It fails when the lots hold fewer, as they
+// must always add up to the stock.
+func takeLots(stub shim.ChaincodeStubInterface, companyID string, specID string, how int) ([]lot, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("lot", []string{companyID, specID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	taken := []lot{}
+	remaining := how
+	for remaining > 0 && resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var l lot
+		if err := json.Unmarshal(response.Value, &l); err != nil {
+			return nil, fmt.Errorf("Failed to decode JSON of: %s", response.Key)
+		}
+		take := l.How
+		if take > remaining {
+			take = remaining
+		}
+		remaining -= take
+		l.How -= take
+		taken = append(taken, lot{CompanyID: companyID, SpecID: specID, DotWeek: l.DotWeek, How: take})
+
+		if l.How == 0 {
+			err = stub.DelState(response.Key)
+		} else {
+			var lotJSONasBytes []byte
+			lotJSONasBytes, err = json.Marshal(l)
+			if err == nil {
+				err = putByOwner(stub, companyID, response.Key, lotJSONasBytes)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if remaining > 0 {
+		return nil, fmt.Errorf("The lots of %s-%s hold only %d of the %d requested", companyID, specID, how-remaining, how)
+	}
+	return taken, nil
+}
+
+// recordLotSales keeps, for every DOT week a sale took tyres from, who
+// bought how many. Tyres of an unknown week can not be recalled and are
+// left out.
+func recordLotSales(stub shim.ChaincodeStubInterface, s *selling, taken []lot) error {
+	for _, l := range taken {
+		if l.DotWeek == "" {
+			continue
+		}
+		week, err := lotWeek(l.DotWeek)
+		if err != nil {
+			return err
+		}
+		key, err := stub.CreateCompositeKey("lot~sale", []string{l.CompanyID, l.SpecID, week, strconv.Itoa(s.OrderID)})
+		if err != nil {
+			return err
+		}
+		saleAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return err
+		}
+		ls := lotSale{CompanyID: l.CompanyID, OrderID: s.OrderID, Client: s.Client, SpecID: l.SpecID, DotWeek: l.DotWeek, AccTime: s.AccTime}
+		if saleAsBytes != nil {
+			if err := json.Unmarshal(saleAsBytes, &ls); err != nil {
+				return fmt.Errorf("Failed to decode JSON of lot sale: %s-%d", l.CompanyID, s.OrderID)
+			}
+		}
+		ls.How += l.How
+		saleJSONasBytes, err := json.Marshal(ls)
+		if err != nil {
+			return err
+		}
+		if err := putByOwner(stub, l.CompanyID, key, saleJSONasBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lotTotals returns the tyres in all lots of an item and in its
+// unknownWeek lot.
+func lotTotals(stub shim.ChaincodeStubInterface, companyID string, specID string) (int, int, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("lot", []string{companyID, specID})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resultsIterator.Close()
+
+	total, unknown := 0, 0
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, 0, err
+		}
+		var l lot
+		if err := json.Unmarshal(response.Value, &l); err != nil {
+			return 0, 0, fmt.Errorf("Failed to decode JSON of: %s", response.Key)
+		}
+		total += l.How
+		if l.DotWeek == "" {
+			unknown = l.How
+		}
+	}
+	return total, unknown, nil
+}
+
+// reconcileLots makes the lots of an item add up to its stock after a
+// correction that names no DOT week. Stock added goes into the unknownWeek
+// lot; stock removed comes out of the unknownWeek lot first and then the
+// oldest lots. The stub must read back its own writes.
+func reconcileLots(stub shim.ChaincodeStubInterface, i *item) error {
+	total, unknown, err := lotTotals(stub, i.CompanyID, i.SpecID)
+	if err != nil {
+		return err
+	}
+	if i.How3 == total {
+		return nil
+	}
+	if i.How3 > total {
+		return addLot(stub, i.CompanyID, i.SpecID, unknownWeek, i.How3-total)
+	}
+	take := total - i.How3
+	if unknown > take {
+		unknown = take
+	}
+	if unknown > 0 {
+		if err := addLot(stub, i.CompanyID, i.SpecID, unknownWeek, -unknown); err != nil {
+			return err
+		}
+	}
+	_, err = takeLots(stub, i.CompanyID, i.SpecID, take-unknown)
+	return err
+}
+
+// deleteLots removes the lots of an item.
+func deleteLots(stub shim.ChaincodeStubInterface, companyID string, specID string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("lot", []string{companyID, specID})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		if err := stub.DelState(response.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ==================================================
+// stockAgeing - stock of a company by years since production
+// ==================================================
+func (t *ItemChaincode) StockAgeing(ctx contractapi.TransactionContextInterface, companyID string) (*stockAgeing, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start stockAgeing")
+	// ==== Input sanitation ====
+	if len(companyID) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	// ages are counted to the transaction time so every peer agrees
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	txTime := time.Unix(txTimestamp.Seconds, 0).UTC()
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("lot", []string{companyID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	report := stockAgeing{CompanyID: companyID, Buckets: map[string]int{}, Lots: []lotAge{}}
+	for _, bucket := range ageBuckets {
+		report.Buckets[bucket] = 0
+	}
+	report.Buckets["unknown"] = 0
+
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			return nil, err
+		}
+		var l lot
+		if err := json.Unmarshal(response.Value, &l); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+
+		if keyParts[2] == unknownWeek {
+			report.Buckets["unknown"] += l.How
+			report.Lots = append(report.Lots, lotAge{SpecID: l.SpecID, How: l.How, AgeWeeks: -1})
+			continue
+		}
+		age := txTime.Sub(productionTime(keyParts[2]))
+		years := int(age.Hours() / 24 / 365.25)
+		if years < 0 {
+			years = 0
+		}
+		if years >= len(ageBuckets) {
+			years = len(ageBuckets) - 1
+		}
+		report.Buckets[ageBuckets[years]] += l.How
+		report.Lots = append(report.Lots, lotAge{
+			SpecID:   l.SpecID,
+			DotWeek:  l.DotWeek,
+			How:      l.How,
+			AgeWeeks: int(age.Hours() / 24 / 7),
+		})
+	}
+	sort.SliceStable(report.Lots, func(a, b int) bool { return report.Lots[a].AgeWeeks > report.Lots[b].AgeWeeks })
+
+	fmt.Println("- end stockAgeing")
+	return &report, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// storeChaincode is the name this chaincode is installed under.
+const storeChaincode = "store"
+
+// costTransientKey is the transient field create reads the cost of new
+// stock from, so it never appears in the proposal written to the block.
+const costTransientKey = "cost"
+
+// itemCost is the cost of the stock of an item, kept only in the private
+// data collection of the company's owner.
+type itemCost struct {
+	CompanyID string  `json:"company_id"`
+	SpecID    string  `json:"spec_id"`
+	Cost      float64 `json:"cost"`
+}
+
+// costCollection is the private data collection of the owner of a company,
+// e.g. "Org1MSPCosts", holding the cost of its items, its cost layers and
+// the cost of its sales. Each organisation's collection is defined in
+// collections_config.json with only that organisation as member.
+func costCollection(stub shim.ChaincodeStubInterface, companyID string) (string, error) {
+	mspID, err := ownerOf(stub, companyID)
+	if err != nil {
+		return "", err
+	}
+	return mspID + "Costs", nil
+}
+
+// readCost sets the cost of an item from the owner's collection. Items
+// written before costs were private keep the cost of their public record.
+func readCost(stub shim.ChaincodeStubInterface, i *item) error {
+	collection, err := costCollection(stub, i.CompanyID)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s-%s", i.CompanyID, i.SpecID)
+	costAsBytes, err := stub.GetPrivateData(collection, key)
+	if err != nil {
+		return err
+	} else if costAsBytes == nil {
+		return nil
+	}
+	var ic itemCost
+	if err := json.Unmarshal(costAsBytes, &ic); err != nil {
+		return fmt.Errorf("Failed to decode JSON of cost: %s", key)
+	}
+	i.Cost = ic.Cost
+	return nil
+}
+
+// writeCost saves the cost of an item in the owner's collection.
+func writeCost(stub shim.ChaincodeStubInterface, i *item) error {
+	collection, err := costCollection(stub, i.CompanyID)
+	if err != nil {
+		return err
+	}
+	costJSONasBytes, err := json.Marshal(itemCost{CompanyID: i.CompanyID, SpecID: i.SpecID, Cost: i.Cost})
+	if err != nil {
+		return err
+	}
+	return putPrivateByOwner(stub, i.CompanyID, collection, fmt.Sprintf("%s-%s", i.CompanyID, i.SpecID), costJSONasBytes)
+}
+
+// readTransientCost sets the cost of an item from the transient "cost"
+// field, a number. The public argument may not carry a cost.
+func readTransientCost(stub shim.ChaincodeStubInterface, i *item) error {
+	if i.Cost != 0 {
+		return errors.New("cost must be passed in the transient field " + costTransientKey)
+	}
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return err
+	}
+	costAsBytes, ok := transient[costTransientKey]
+	if !ok {
+		return nil
+	}
+	cost, err := strconv.ParseFloat(string(costAsBytes), 64)
+	if err != nil {
+		return fmt.Errorf("transient %s must be a number", costTransientKey)
+	}
+	i.Cost = cost
+	return nil
+}
+
+// calledByChaincode fails when a client invoked this chaincode directly.
+// Receipts, adjustments and issues carry costs: the arguments and result of
+// a call from another chaincode stay off the block, those of a client's
+// proposal are written to it.
+func calledByChaincode(stub shim.ChaincodeStubInterface, function string) error {
+	signedProposal, err := stub.GetSignedProposal()
+	if err != nil {
+		return err
+	}
+	proposal := &peer.Proposal{}
+	if err := proto.Unmarshal(signedProposal.ProposalBytes, proposal); err != nil {
+		return err
+	}
+	header := &common.Header{}
+	if err := proto.Unmarshal(proposal.Header, header); err != nil {
+		return err
+	}
+	channelHeader := &common.ChannelHeader{}
+	if err := proto.Unmarshal(header.ChannelHeader, channelHeader); err != nil {
+		return err
+	}
+	extension := &peer.ChaincodeHeaderExtension{}
+	if err := proto.Unmarshal(channelHeader.Extension, extension); err != nil {
+		return err
+	}
+	if extension.ChaincodeId == nil || extension.ChaincodeId.Name == storeChaincode {
+		return errors.New(function + " may only be called by the purchase and sell chaincodes")
+	}
+	return nil
+}
+
+// moveCosts moves the item costs, cost layers and sale costs of a company
+// from the private collection of its owner to that of its new owner, under
+// the new owner's endorsement.
+func moveCosts(stub shim.ChaincodeStubInterface, companyID string, fromMSPID string, toMSPID string) error {
+	from, to := fromMSPID+"Costs", toMSPID+"Costs"
+	if from == to {
+		return nil
+	}
+	resultsIterator, err := stub.GetStateByRange(companyID+"-", companyID+".")
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	keys := []string{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		keys = append(keys, response.Key)
+	}
+	for _, objectType := range []string{"layer", "cogs"} {
+		privateIterator, err := stub.GetPrivateDataByPartialCompositeKey(from, objectType, []string{companyID})
+		if err != nil {
+			return err
+		}
+		for privateIterator.HasNext() {
+			response, err := privateIterator.Next()
+			if err != nil {
+				privateIterator.Close()
+				return err
+			}
+			keys = append(keys, response.Key)
+		}
+		privateIterator.Close()
+	}
+
+	for _, key := range keys {
+		valueAsBytes, err := stub.GetPrivateData(from, key)
+		if err != nil {
+			return err
+		} else if valueAsBytes == nil {
+			continue
+		}
+		if err := stub.PutPrivateData(to, key, valueAsBytes); err != nil {
+			return err
+		}
+		if err := endorsePrivateBy(stub, to, key, toMSPID); err != nil {
+			return err
+		}
+		if err := stub.DelPrivateData(from, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
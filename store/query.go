@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxPageSize caps the items returned by one richQuery page.
+const maxPageSize = 200
+
+// queryFields are the fields of an item a richQuery selector may use. The
+// cost is kept private and cannot be selected on.
+var queryFields = map[string]bool{
+	"company_id": true,
+	"spec_id":    true,
+	"how3":       true,
+}
+
+// fieldOperators are the Mango operators comparing the value of a field.
+var fieldOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true,
+	"$in": true, "$nin": true, "$exists": true, "$all": true, "$size": true,
+}
+
+// queryRecord is one item found by richQuery.
+type queryRecord struct {
+	Key    string `json:"key"`
+	Record item   `json:"record"`
+}
+
+// queryPage is one page of richQuery results. Fetched counts the records
+// CouchDB read for the page; a page with fewer than pageSize is the last.
+type queryPage struct {
+	Records  []queryRecord `json:"records"`
+	Fetched  int32         `json:"fetched"`
+	Bookmark string        `json:"bookmark"`
+}
+
+// checkSelector rejects selectors on fields outside queryFields and
+// operators other than the comparisons and combinations of fields. field is
+// the path the selector applies to, "" at the top.
+func checkSelector(selector map[string]interface{}, field string) error {
+	for name, value := range selector {
+		switch {
+		case name == "$and" || name == "$or" || name == "$nor":
+			selectors, ok := value.([]interface{})
+			if !ok {
+				return fmt.Errorf("%s takes a list of selectors", name)
+			}
+			for _, s := range selectors {
+				sub, ok := s.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("%s takes a list of selectors", name)
+				}
+				if err := checkSelector(sub, field); err != nil {
+					return err
+				}
+			}
+		case name == "$not":
+			sub, ok := value.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s takes a selector", name)
+			}
+			if err := checkSelector(sub, field); err != nil {
+				return err
+			}
+		case fieldOperators[name]:
+			if !queryFields[field] {
+				if field == "" {
+					return fmt.Errorf("%s must be applied to a field", name)
+				}
+				return fmt.Errorf("Field %s may not be queried", field)
+			}
+		case strings.HasPrefix(name, "$"):
+			return fmt.Errorf("Operator %s may not be used", name)
+		default:
+			path := name
+			if field != "" {
+				path = field + "." + name
+			}
+			if sub, ok := value.(map[string]interface{}); ok {
+				if err := checkSelector(sub, path); err != nil {
+					return err
+				}
+			} else if !queryFields[path] {
+				return fmt.Errorf("Field %s may not be queried", path)
+			}
+		}
+	}
+	return nil
+}
+
+// ============================================================
+// richQuery - find stock with a CouchDB selector on the fields of
+// queryFields, pageSize at a time. Pass the returned bookmark to the next
+// call for the following page. Only for queries: the peer does not
+// re-execute selectors at commit, so results may be stale in a submitted
+// transaction.
+// args: selector, pageSize, bookmark ("" to start)
+// ============================================================
+func (t *ItemChaincode) RichQuery(ctx contractapi.TransactionContextInterface, selectorJSON string, pageSize int, bookmark string) (*queryPage, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start richQuery")
+	if pageSize <= 0 || pageSize > maxPageSize {
+		return nil, fmt.Errorf("pageSize must be between 1 and %d", maxPageSize)
+	}
+
+	// ==== Pass numbers on as written rather than as floats ====
+	var selector map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(selectorJSON)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&selector); err != nil || selector == nil {
+		return nil, fmt.Errorf("Invalid json format - %s", selectorJSON)
+	}
+	if err := checkSelector(selector, ""); err != nil {
+		return nil, err
+	}
+	queryAsBytes, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, metadata, err := stub.GetQueryResultWithPagination(string(queryAsBytes), int32(pageSize), bookmark)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	page := queryPage{Records: []queryRecord{}, Fetched: metadata.FetchedRecordsCount, Bookmark: metadata.Bookmark}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		// lots, serials and the other records share the namespace
+		if !isDocumentKey(response.Key) {
+			continue
+		}
+		var i item
+		if err := decodeItem(response.Value, &i); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		i.normalizeLocations()
+		page.Records = append(page.Records, queryRecord{Key: response.Key, Record: i})
+	}
+
+	fmt.Println("- end richQuery")
+	return &page, nil
+}
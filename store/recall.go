@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// recall is a manufacturer recall of some specs produced in a range of DOT
+// weeks. Weeks are written as on the sidewall, WWYY, e.g. "2319" for week 23
+// of 2019.
+type recall struct {
+	RecallID   string `json:"recall_id"`
+	SpecIDs    []int  `json:"spec_ids"`
+	FromWeek   string `json:"from_week"`
+	ToWeek     string `json:"to_week"`
+	IssuedTime int64  `json:"issued_time" metadata:",optional"`
+	Note       string `json:"note" metadata:",optional"`
+}
+
+type recallStock struct {
+	CompanyID string   `json:"company_id"`
+	SpecID    string   `json:"spec_id"`
+	How       int      `json:"how"`
+	Serials   []string `json:"serials"`
+}
+
+// recallSale is a sale that shipped recalled tyres: one serial, or how many
+// of a DOT week for a sale that named no serials.
+type recallSale struct {
+	CompanyID string `json:"company_id"`
+	OrderID   int    `json:"order_id"`
+	Client    string `json:"client"`
+	SpecID    string `json:"spec_id"`
+	DotWeek   string `json:"dot_week"`
+	How       int    `json:"how"`
+	Serial    string `json:"serial,omitempty" metadata:",optional"`
+}
+
+type recallImpact struct {
+	RecallID string        `json:"recall_id"`
+	InStock  []recallStock `json:"in_stock"`
+	Sold     []recallSale  `json:"sold"`
+}
+
+// dotWeek turns a DOT week "WWYY" into YYWW so weeks compare in time order.
+func dotWeek(week string) (int, error) {
+	if len(week) != 4 {
+		return 0, fmt.Errorf("DOT week %s must be 4 digits WWYY", week)
+	}
+	ww, err := strconv.Atoi(week[:2])
+	if err != nil || ww < 1 || ww > 53 {
+		return 0, fmt.Errorf("DOT week %s must be 4 digits WWYY", week)
+	}
+	yy, err := strconv.Atoi(week[2:])
+	if err != nil {
+		return 0, fmt.Errorf("DOT week %s must be 4 digits WWYY", week)
+	}
+	return yy*100 + ww, nil
+}
+
+// serialWeek is the production week of a tyre, the last four digits of its
+// DOT serial.
+func serialWeek(serial string) (int, bool) {
+	if len(serial) < 4 {
+		return 0, false
+	}
+	week, err := dotWeek(serial[len(serial)-4:])
+	return week, err == nil
+}
+
+// ============================================================
+// createRecall - record a manufacturer recall
+// ============================================================
+func (t *ItemChaincode) CreateRecall(ctx contractapi.TransactionContextInterface, r recall) error {
+	stub := ctx.GetStub()
+	var err error
+
+	// ==== Input sanitation ====
+	fmt.Println("- start createRecall")
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, managerRole); err != nil {
+		return errors.New("Only a " + managerRole + " may create a recall")
+	}
+	if r.RecallID == "" {
+		return errors.New("recall_id must be required")
+	}
+	if len(r.SpecIDs) == 0 {
+		return errors.New("spec_ids must be required")
+	}
+	from, err := dotWeek(r.FromWeek)
+	if err != nil {
+		return err
+	}
+	to, err := dotWeek(r.ToWeek)
+	if err != nil {
+		return err
+	}
+	if from > to {
+		return errors.New("from_week must not be after to_week")
+	}
+
+	key, err := stub.CreateCompositeKey("recall", []string{r.RecallID})
+	if err != nil {
+		return err
+	}
+	recallAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errors.New("Failed to get recall: " + err.Error())
+	} else if recallAsBytes != nil {
+		msg := fmt.Sprintf("The recall %s has already existed!", r.RecallID)
+		return errors.New(msg)
+	}
+
+	recallJSONasBytes, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, recallJSONasBytes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("- end createRecall")
+	return nil
+}
+
+func getRecall(stub shim.ChaincodeStubInterface, recallID string) (*recall, error) {
+	key, err := stub.CreateCompositeKey("recall", []string{recallID})
+	if err != nil {
+		return nil, err
+	}
+	recallAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	} else if recallAsBytes == nil {
+		return nil, fmt.Errorf("Nil recall for %s", recallID)
+	}
+	var r recall
+	if err := json.Unmarshal(recallAsBytes, &r); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of recall: %s", recallID)
+	}
+	return &r, nil
+}
+
+// ==================================================
+// queryRecall - query a recall by ID
+// ==================================================
+func (t *ItemChaincode) QueryRecall(ctx contractapi.TransactionContextInterface, recallID string) (*recall, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start queryRecall")
+	r, err := getRecall(stub, recallID)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end queryRecall")
+	return r, nil
+}
+
+// ==================================================
+// recallImpact - recalled tyres in stock and the sales that shipped them
+// ==================================================
+func (t *ItemChaincode) RecallImpact(ctx contractapi.TransactionContextInterface, recallID string) (*recallImpact, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start recallImpact")
+	r, err := getRecall(stub, recallID)
+	if err != nil {
+		return nil, err
+	}
+	from, _ := dotWeek(r.FromWeek)
+	to, _ := dotWeek(r.ToWeek)
+
+	impact := recallImpact{RecallID: r.RecallID, InStock: []recallStock{}, Sold: []recallSale{}}
+	recalled := map[string]bool{}
+	for _, specID := range r.SpecIDs {
+		recalled[strconv.Itoa(specID)] = true
+	}
+
+	// ==== In-stock quantities come from the lots of every company ====
+	stock := map[string]*recallStock{}
+	lotsIterator, err := stub.GetStateByPartialCompositeKey("lot", []string{})
+	if err != nil {
+		return nil, err
+	}
+	for lotsIterator.HasNext() {
+		response, err := lotsIterator.Next()
+		if err != nil {
+			lotsIterator.Close()
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			lotsIterator.Close()
+			return nil, err
+		}
+		if !recalled[keyParts[1]] || keyParts[2] == unknownWeek {
+			continue
+		}
+		week, _ := strconv.Atoi(keyParts[2])
+		if week < from || week > to {
+			continue
+		}
+		var l lot
+		if err := json.Unmarshal(response.Value, &l); err != nil {
+			lotsIterator.Close()
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		stockKey := l.CompanyID + "-" + l.SpecID
+		rs, ok := stock[stockKey]
+		if !ok {
+			rs = &recallStock{CompanyID: l.CompanyID, SpecID: l.SpecID, Serials: []string{}}
+			stock[stockKey] = rs
+		}
+		rs.How += l.How
+	}
+	lotsIterator.Close()
+
+	// ==== Serials name the tyres in stock and the sales that shipped them ====
+	for _, specID := range r.SpecIDs {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey("spec~serial", []string{strconv.Itoa(specID)})
+		if err != nil {
+			return nil, err
+		}
+		for resultsIterator.HasNext() {
+			response, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			_, keyParts, err := stub.SplitCompositeKey(response.Key)
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			week, ok := serialWeek(keyParts[1])
+			if !ok || week < from || week > to {
+				continue
+			}
+			sr, err := getSerial(stub, keyParts[1])
+			if err != nil || sr == nil {
+				resultsIterator.Close()
+				return nil, errors.New("Failed to get serial: " + keyParts[1])
+			}
+
+			if rs, ok := stock[sr.CompanyID+"-"+sr.SpecID]; ok && sr.InStock {
+				rs.Serials = append(rs.Serials, sr.Serial)
+			}
+			for _, e := range sr.History {
+				if e.Event == "sold" {
+					impact.Sold = append(impact.Sold, recallSale{
+						CompanyID: e.CompanyID,
+						OrderID:   e.OrderID,
+						Client:    e.Client,
+						SpecID:    sr.SpecID,
+						DotWeek:   sr.Serial[len(sr.Serial)-4:],
+						How:       1,
+						Serial:    sr.Serial,
+					})
+				}
+			}
+		}
+		resultsIterator.Close()
+	}
+
+	// ==== Sales that named no serials are recorded by the DOT weeks they took ====
+	salesIterator, err := stub.GetStateByPartialCompositeKey("lot~sale", []string{})
+	if err != nil {
+		return nil, err
+	}
+	for salesIterator.HasNext() {
+		response, err := salesIterator.Next()
+		if err != nil {
+			salesIterator.Close()
+			return nil, err
+		}
+		_, keyParts, err := stub.SplitCompositeKey(response.Key)
+		if err != nil {
+			salesIterator.Close()
+			return nil, err
+		}
+		if !recalled[keyParts[1]] {
+			continue
+		}
+		week, _ := strconv.Atoi(keyParts[2])
+		if week < from || week > to {
+			continue
+		}
+		var ls lotSale
+		if err := json.Unmarshal(response.Value, &ls); err != nil {
+			salesIterator.Close()
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		impact.Sold = append(impact.Sold, recallSale{
+			CompanyID: ls.CompanyID,
+			OrderID:   ls.OrderID,
+			Client:    ls.Client,
+			SpecID:    ls.SpecID,
+			DotWeek:   ls.DotWeek,
+			How:       ls.How,
+		})
+	}
+	salesIterator.Close()
+
+	for _, rs := range stock {
+		impact.InStock = append(impact.InStock, *rs)
+	}
+	sort.Slice(impact.InStock, func(a, b int) bool {
+		if impact.InStock[a].CompanyID != impact.InStock[b].CompanyID {
+			return impact.InStock[a].CompanyID < impact.InStock[b].CompanyID
+		}
+		return impact.InStock[a].SpecID < impact.InStock[b].SpecID
+	})
+	sort.Slice(impact.Sold, func(a, b int) bool {
+		if impact.Sold[a].CompanyID != impact.Sold[b].CompanyID {
+			return impact.Sold[a].CompanyID < impact.Sold[b].CompanyID
+		}
+		if impact.Sold[a].OrderID != impact.Sold[b].OrderID {
+			return impact.Sold[a].OrderID < impact.Sold[b].OrderID
+		}
+		if impact.Sold[a].SpecID != impact.Sold[b].SpecID {
+			return impact.Sold[a].SpecID < impact.Sold[b].SpecID
+		}
+		if impact.Sold[a].DotWeek != impact.Sold[b].DotWeek {
+			return impact.Sold[a].DotWeek < impact.Sold[b].DotWeek
+		}
+		return impact.Sold[a].Serial < impact.Sold[b].Serial
+	})
+
+	fmt.Println("- end recallImpact")
+	return &impact, nil
+}
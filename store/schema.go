@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// schemaVersion is the shape of the items this chaincode writes. Version 1 is
+// everything written before items carried a version: company_id and spec_id
+// may be numbers. From version 3 the lots of an item add up to its stock;
+// stock booked before without a DOT week is in the unknown lot. The cost
+// moves to the owner's cost collection.
+const schemaVersion = 3
+
+// migration is the result of one migrate batch. Bookmark is where the next
+// batch starts; it is empty when done.
+type migration struct {
+	Scanned  int    `json:"scanned"`
+	Migrated int    `json:"migrated"`
+	Bookmark string `json:"bookmark"`
+	Done     bool   `json:"done"`
+}
+
+// upgradeV1 rewrites a version 1 item, decoded into a map, to version 2.
+func upgradeV1(doc map[string]interface{}) {
+	for _, field := range []string{"company_id", "spec_id"} {
+		if n, ok := doc[field].(float64); ok {
+			doc[field] = strconv.FormatFloat(n, 'f', -1, 64)
+		}
+	}
+}
+
+// decodeItem unmarshals a stored item of any schema version.
+func decodeItem(docAsBytes []byte, i *item) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(docAsBytes, &doc); err != nil {
+		return err
+	}
+	version, _ := doc["schema_version"].(float64)
+	if int(version) < 2 {
+		upgradeV1(doc)
+	}
+	doc["schema_version"] = schemaVersion
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(upgraded, i)
+}
+
+// isDocumentKey tells the "<company_id>-<spec_id>" keys of items from
+// the other simple keys of the namespace.
+func isDocumentKey(key string) bool {
+	n := strings.LastIndex(key, "-")
+	if n <= 0 {
+		return false
+	}
+	_, err := strconv.Atoi(key[n+1:])
+	return err == nil
+}
+
+// ============================================================
+// migrate - rewrite items of older schema versions in the current one,
+// batchSize keys at a time. Pass the returned bookmark to the next call
+// until done.
+// args: batchSize, bookmark ("" to start)
+// ============================================================
+func (t *ItemChaincode) Migrate(ctx contractapi.TransactionContextInterface, batchSize int, bookmark string) (*migration, error) {
+	stub := newTxStub(ctx.GetStub())
+	fmt.Println("- start migrate")
+	if batchSize <= 0 {
+		return nil, errors.New("batchSize must be positive")
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, adminRole); err != nil {
+		return nil, errors.New("Only an " + adminRole + " may migrate")
+	}
+
+	resultsIterator, err := stub.GetStateByRange(bookmark, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	m := migration{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if m.Scanned == batchSize {
+			m.Bookmark = response.Key
+			break
+		}
+		m.Scanned++
+		if !isDocumentKey(response.Key) {
+			continue
+		}
+
+		var version struct {
+			SchemaVersion int `json:"schema_version"`
+		}
+		if err := json.Unmarshal(response.Value, &version); err == nil && version.SchemaVersion >= schemaVersion {
+			continue
+		}
+		var i item
+		if err := decodeItem(response.Value, &i); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		if err := putItem(stub, &i); err != nil {
+			return nil, err
+		}
+		if err := reconcileLots(stub, &i); err != nil {
+			return nil, err
+		}
+		m.Migrated++
+	}
+	m.Done = m.Bookmark == ""
+
+	fmt.Println("- end migrate")
+	return &m, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeItem(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    item
+		wantErr bool
+	}{
+		{
+			name: "version 1 with numbers",
+			doc:  `{"company_id":3,"spec_id":1500000,"how3":8,"cost":62.5}`,
+			want: item{SchemaVersion: 3, CompanyID: "3", SpecID: "1500000", How3: 8, Cost: 62.5},
+		},
+		{
+			name: "version 1 with strings",
+			doc:  `{"company_id":"3","spec_id":"1111","how3":8}`,
+			want: item{SchemaVersion: 3, CompanyID: "3", SpecID: "1111", How3: 8},
+		},
+		{
+			name: "version 2",
+			doc:  `{"schema_version":2,"company_id":"3","spec_id":"1111","how3":8,"locations":{"A":5,"B":3}}`,
+			want: item{SchemaVersion: 3, CompanyID: "3", SpecID: "1111", How3: 8, Locations: map[string]int{"A": 5, "B": 3}},
+		},
+		{
+			name:    "not JSON",
+			doc:     `3-1111`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var i item
+			err := decodeItem([]byte(tt.doc), &i)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(i, tt.want) {
+				t.Errorf("got %+v, want %+v", i, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// serialEvent is one step in the chain of custody of a tyre.
+type serialEvent struct {
+	Event     string `json:"event"`
+	CompanyID string `json:"company_id"`
+	OrderID   int    `json:"order_id"`
+	Client    string `json:"client"`
+	AccTime   int64  `json:"acc_time"`
+}
+
+// serialRecord follows one physical tyre, identified by its DOT serial,
+// from the purchase that received it to the sale that shipped it.
+type serialRecord struct {
+	Serial    string        `json:"serial"`
+	SpecID    string        `json:"spec_id"`
+	CompanyID string        `json:"company_id"`
+	InStock   bool          `json:"in_stock"`
+	History   []serialEvent `json:"history"`
+}
+
+func getSerial(stub shim.ChaincodeStubInterface, serial string) (*serialRecord, error) {
+	key, err := stub.CreateCompositeKey("serial", []string{serial})
+	if err != nil {
+		return nil, err
+	}
+	serialAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if serialAsBytes == nil {
+		return nil, nil
+	}
+	var sr serialRecord
+	if err := json.Unmarshal(serialAsBytes, &sr); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of serial: %s", serial)
+	}
+	return &sr, nil
+}
+
+// putSerial saves a serial under the endorsement of the owner of the
+// company that last held it. A sold tyre stays under the selling company's
+// owner until another company receives it.
+func putSerial(stub shim.ChaincodeStubInterface, sr *serialRecord) error {
+	key, err := stub.CreateCompositeKey("serial", []string{sr.Serial})
+	if err != nil {
+		return err
+	}
+	serialJSONasBytes, err := json.Marshal(sr)
+	if err != nil {
+		return err
+	}
+	return putByOwner(stub, sr.CompanyID, key, serialJSONasBytes)
+}
+
+// endorseSerials puts the serials in stock at a company under the
+// endorsement of mspID.
+func endorseSerials(stub shim.ChaincodeStubInterface, companyID string, mspID string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("serial", []string{})
+	if err != nil {
+		return err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+		var sr serialRecord
+		if err := json.Unmarshal(response.Value, &sr); err != nil {
+			return fmt.Errorf("Failed to decode JSON of: %s", response.Key)
+		}
+		if sr.CompanyID != companyID {
+			continue
+		}
+		if err := endorseBy(stub, response.Key, mspID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSerialCount fails when a line lists serials but not one per tyre.
+func checkSerialCount(specID int, how int, serials []string) error {
+	if len(serials) > 0 && len(serials) != how {
+		return fmt.Errorf("spec_id %d lists %d serials for %d tyres", specID, len(serials), how)
+	}
+	seen := map[string]bool{}
+	for _, serial := range serials {
+		if serial == "" {
+			return fmt.Errorf("spec_id %d lists an empty serial", specID)
+		}
+		if seen[serial] {
+			return fmt.Errorf("serial %s is listed twice", serial)
+		}
+		seen[serial] = true
+	}
+	return nil
+}
+
+// receiveSerials puts the serials of a purchase line into stock at the
+// purchasing company.
+func receiveSerials(stub shim.ChaincodeStubInterface, p *purchase, line *subPurchase) error {
+	for _, serial := range line.Serials {
+		sr, err := getSerial(stub, serial)
+		if err != nil {
+			return err
+		}
+		if sr == nil {
+			sr = &serialRecord{Serial: serial}
+			// index by spec so recalls can find the tyres of a spec
+			indexKey, err := stub.CreateCompositeKey("spec~serial", []string{strconv.Itoa(line.SpecID), serial})
+			if err != nil {
+				return err
+			}
+			if err := putByOwner(stub, p.CompanyID, indexKey, []byte{0x00}); err != nil {
+				return err
+			}
+		} else if sr.SpecID != strconv.Itoa(line.SpecID) {
+			return fmt.Errorf("serial %s is spec_id %s, not %d", serial, sr.SpecID, line.SpecID)
+		} else if sr.InStock {
+			return fmt.Errorf("serial %s is already in stock at company %s", serial, sr.CompanyID)
+		}
+		sr.SpecID = strconv.Itoa(line.SpecID)
+		sr.CompanyID = p.CompanyID
+		sr.InStock = true
+		sr.History = append(sr.History, serialEvent{
+			Event:     "received",
+			CompanyID: p.CompanyID,
+			OrderID:   p.OrderID,
+			Client:    p.Client,
+			AccTime:   p.AccTime,
+		})
+		if err := putSerial(stub, sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// issueSerials takes the serials of a sale line out of stock, failing for
+// any serial that is not in stock at the selling company as that spec.
+func issueSerials(stub shim.ChaincodeStubInterface, s *selling, line *subSelling) error {
+	for _, serial := range line.Serials {
+		sr, err := getSerial(stub, serial)
+		if err != nil {
+			return err
+		}
+		if sr == nil || !sr.InStock || sr.CompanyID != s.CompanyID {
+			return fmt.Errorf("serial %s is not in stock at company %s", serial, s.CompanyID)
+		}
+		if sr.SpecID != strconv.Itoa(line.SpecID) {
+			return fmt.Errorf("serial %s is spec_id %s, not %d", serial, sr.SpecID, line.SpecID)
+		}
+		sr.InStock = false
+		sr.History = append(sr.History, serialEvent{
+			Event:     "sold",
+			CompanyID: s.CompanyID,
+			OrderID:   s.OrderID,
+			Client:    s.Client,
+			AccTime:   s.AccTime,
+		})
+		if err := putSerial(stub, sr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ==================================================
+// traceSerial - chain of custody of a tyre by DOT serial
+// ==================================================
+func (t *ItemChaincode) TraceSerial(ctx contractapi.TransactionContextInterface, serial string) (*serialRecord, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start traceSerial")
+	// ==== Input sanitation ====
+	if len(serial) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	sr, err := getSerial(stub, serial)
+	if err != nil {
+		return nil, err
+	}
+	if sr == nil {
+		jsonResp := "{\"Error\":\"Nil serial for " + serial + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+	fmt.Println("- end traceSerial")
+	return sr, nil
+}
@@ -1,81 +1,116 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"time"
 
-	"github.com/hyperledger/fabric/tree/release-1.1/core/chaincode/shim"
-	pb "github.com/hyperledger/fabric/tree/release-1.1/protos/peer"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Names of the other chaincodes, installed on the same channel. Items may
+// only be booked for registered specs and not into a period closed in the
+// period chaincode.
+const (
+	specChaincode   = "spec"
+	periodChaincode = "period"
 )
 
 type ItemChaincode struct {
+	contractapi.Contract
 }
 
+// item is the stock of a spec in a company. How3 is the total over all
+// locations. Cost is kept in the owner's cost collection, not in public
+// state.
 type item struct {
-	CompanyID string `json:"company_id"`
-	SpecID    string `json:"spec_id"`
-	How3      int    `json:"how3"`
+	SchemaVersion int            `json:"schema_version" metadata:",optional"`
+	CompanyID     string         `json:"company_id"`
+	SpecID        string         `json:"spec_id"`
+	How3          int            `json:"how3"`
+	Cost          float64        `json:"cost,omitempty" metadata:",optional"`
+	Locations     map[string]int `json:"locations,omitempty" metadata:",optional"`
+
+	// isNew is set by getItem for stock not yet on the ledger
+	isNew bool
+}
+
+// itemHistory is one change of an item, Value is left out for a delete.
+type itemHistory struct {
+	TxId      string `json:"TxId"`
+	Value     *item  `json:"Value,omitempty" metadata:",optional"`
+	Timestamp string `json:"Timestamp"`
+	IsDelete  bool   `json:"IsDelete"`
 }
 
 // ===================================================================================
 // Main
 // ===================================================================================
 func main() {
-	err := shim.Start(new(ItemChaincode))
+	chaincode, err := contractapi.NewChaincode(newItemChaincode())
 	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
+		fmt.Printf("Error creating store chaincode: %s", err)
+		return
+	}
+	if err := chaincode.Start(); err != nil {
+		fmt.Printf("Error starting store chaincode: %s", err)
 	}
 }
 
-// ========================================
-// Init initializes chaincode
-// ===========================
-func (t *ItemChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	return shim.Success(nil)
+func newItemChaincode() *ItemChaincode {
+	t := new(ItemChaincode)
+	t.Name = "store"
+	t.Info.Description = "Stock of the companies, its cost layers, lots, serials and recalls"
+	t.BeforeTransaction = checkEnabled
+	return t
+}
+
+// GetEvaluateTransactions marks the transactions that only read the ledger,
+// so clients query rather than submit them.
+func (t *ItemChaincode) GetEvaluateTransactions() []string {
+	return []string{
+		"Query", "GetHistory", "MarginReport", "StockAgeing", "TraceSerial",
+		"QueryRecall", "RecallImpact", "QueryConfig", "RichQuery",
+	}
 }
 
 // ========================================
-// Invoke - Our entry point for Invocations
+// Init initializes chaincode
 // ========================================
-func (t *ItemChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
-	function, args := stub.GetFunctionAndParameters()
-	fmt.Println("invoke is running " + function)
-
-	// Handle different functions
-	if function == "create" { //create a new item
-		return t.create(stub, args)
-	} else if function == "delete" {
-		return t.delete(stub, args)
-	} else if function == "update" {
-		return t.update(stub, args)
-	} else if function == "query" {
-		return t.query(stub, args)
-	} else if function == "getHistory" {
-		return t.getHistory(stub, args)
-	}
-
-	fmt.Println("invoke did not find func: " + function) //error
-	return shim.Error("Received unknown function invocation")
+// Instantiate may call init with the first configuration, as an admin.
+// Without a function the contract API succeeds and the stored settings are
+// kept. As init stays callable afterwards, it refuses to replace a
+// configuration; setConfig changes it.
+func (t *ItemChaincode) Init(ctx contractapi.TransactionContextInterface, c config) error {
+	stub := ctx.GetStub()
+	configAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return err
+	}
+	if configAsBytes != nil {
+		return errors.New("The configuration is already set, use setConfig to change it")
+	}
+	if err := ctx.GetClientIdentity().AssertAttributeValue(roleAttribute, adminRole); err != nil {
+		return errors.New("Only an " + adminRole + " may set the configuration")
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+	return putConfig(stub, &c)
 }
 
 // ============================================================
 // create - create a new item, store into chaincode state
 // ============================================================
-func (t *ItemChaincode) create(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *ItemChaincode) Create(ctx contractapi.TransactionContextInterface, i item) error {
+	stub := newTxStub(ctx.GetStub())
 	var err error
 
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
-	}
-
 	// ==== Input sanitation ====
 	fmt.Println("- start create item")
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
-	}
 
 	// companyID := args[0]
 	// specID := args[1]
@@ -85,22 +120,29 @@ func (t *ItemChaincode) create(stub shim.ChaincodeStubInterface, args []string)
 	// if err != nil {
 	// 	return shim.Error("argument how3 must be a numeric string")
 	// }
-	var i item
-	itemJSONasBytes := []byte(args[0])
-	if err := json.Unmarshal(itemJSONasBytes, &i); err != nil {
-		msg := fmt.Sprintf("%s", args[0])
-		return shim.Error(msg)
-		// return shim.Error("Invalid json format")
+	if err := checkSpecs(stub, []string{i.SpecID}); err != nil {
+		return err
+	}
+	if err := checkCompany(stub, i.CompanyID); err != nil {
+		return err
+	}
+	i.SchemaVersion = schemaVersion
+	if err := checkPeriodNow(stub, i.CompanyID); err != nil {
+		return err
+	}
+	i.normalizeLocations()
+	if err := readTransientCost(stub, &i); err != nil {
+		return err
 	}
 	key := fmt.Sprintf("%s-%s", i.CompanyID, i.SpecID)
 
 	// ==== Check if item already exists ====
 	itemAsBytes, err := stub.GetState(key)
 	if err != nil {
-		return shim.Error("Failed to get item: " + err.Error())
+		return errors.New("Failed to get item: " + err.Error())
 	} else if itemAsBytes != nil {
 		msg := fmt.Sprintf("The key %s has already existed!", key)
-		return shim.Error(msg)
+		return errors.New(msg)
 	}
 
 	// ==== Create item object and marshal to JSON ====
@@ -111,211 +153,233 @@ func (t *ItemChaincode) create(stub shim.ChaincodeStubInterface, args []string)
 	// }
 
 	// === Save item to state ===
-	err = stub.PutState(key, itemJSONasBytes)
-	if err != nil {
-		return shim.Error(err.Error())
+	i.isNew = true
+	if err := putItem(stub, &i); err != nil {
+		return err
+	}
+	// the stock has no DOT week, book it into the unknown lot
+	if err := reconcileLots(stub, &i); err != nil {
+		return err
 	}
 
 	// ==== Item saved and indexed. Return success ====
 	fmt.Println("- end create item")
-	return shim.Success(nil)
+	return nil
+}
+
+// checkSpecs fails unless every spec_id is registered in the spec chaincode
+// and has not been discontinued.
+func checkSpecs(stub shim.ChaincodeStubInterface, specIDs []string) error {
+	specIDsAsBytes, err := json.Marshal(specIDs)
+	if err != nil {
+		return err
+	}
+	args := [][]byte{[]byte("check"), specIDsAsBytes}
+	response := stub.InvokeChaincode(specChaincode, args, "")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// checkPeriod fails if accTime falls in a period of the company that the
+// period chaincode has closed.
+func checkPeriod(stub shim.ChaincodeStubInterface, companyID string, accTime int64) error {
+	args := [][]byte{[]byte("check"), []byte(companyID), []byte(strconv.FormatInt(accTime, 10))}
+	response := stub.InvokeChaincode(periodChaincode, args, "")
+	if response.Status != shim.OK {
+		return errors.New(response.Message)
+	}
+	return nil
+}
+
+// checkPeriodNow checks the period of the transaction time, for stock
+// corrections and moves that carry no acc_time of their own.
+func checkPeriodNow(stub shim.ChaincodeStubInterface, companyID string) error {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	return checkPeriod(stub, companyID, txTimestamp.Seconds)
 }
 
 // ============================================================
 // update - update a new item, store into chaincode state
 // ============================================================
-func (t *ItemChaincode) update(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *ItemChaincode) Update(ctx contractapi.TransactionContextInterface, companyID string, specID string, how3 int) error {
+	stub := newTxStub(ctx.GetStub())
 	var err error
 
-	if len(args) != 3 {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
-	}
-
 	// ==== Input sanitation ====
 	fmt.Println("- start update item")
-	if len(args[0]) <= 0 {
-		return shim.Error("1st argument must be a non-empty string")
-	}
-	if len(args[1]) <= 0 {
-		return shim.Error("2nd argument must be a non-empty string")
+	if len(companyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
 	}
-	if len(args[2]) <= 0 {
-		return shim.Error("3rd argument must be a non-empty string")
+	if len(specID) <= 0 {
+		return errors.New("2nd argument must be a non-empty string")
 	}
 
-	companyID := args[0]
-	specID := args[1]
-	how3, err := strconv.Atoi(args[1])
-	if err != nil {
-		return shim.Error("3rd argument must be a numeric string")
+	if err := checkPeriodNow(stub, companyID); err != nil {
+		return err
 	}
 
 	key := fmt.Sprintf("%s-%s", companyID, specID)
 	// ==== Check if item already exists ====
 	itemAsBytes, err := stub.GetState(key)
 	if err != nil {
-		return shim.Error("Failed to get item: " + err.Error())
+		return errors.New("Failed to get item: " + err.Error())
 	} else if itemAsBytes == nil {
 		fmt.Println("This item NOT exists: " + key)
-		return shim.Error("This item NOT exists: " + key)
+		return errors.New("This item NOT exists: " + key)
 	}
 
 	// ==== Update item object and marshal to JSON ====
-	item := &item{companyID, specID, how3}
-	itemJSONasBytes, err := json.Marshal(item)
+	item := &item{}
+	err = decodeItem(itemAsBytes, item)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
+	}
+	if err := readCost(stub, item); err != nil {
+		return err
+	}
+	// the correction is booked at the default location
+	if err := item.addLocation(defaultLocation, how3-item.How3); err != nil {
+		return err
 	}
 
 	// === Save item to state ===
-	err = stub.PutState(key, itemJSONasBytes)
-	if err != nil {
-		return shim.Error(err.Error())
+	if err := putItem(stub, item); err != nil {
+		return err
+	}
+	if err := reconcileLots(stub, item); err != nil {
+		return err
 	}
 
 	// ==== Item saved and indexed. Return success ====
 	fmt.Println("- end update item")
-	return shim.Success(nil)
+	return nil
 }
 
 // ==================================================
 // delete - remove a item from state
 // ==================================================
-func (t *ItemChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *ItemChaincode) Delete(ctx contractapi.TransactionContextInterface, companyID string, specID string) error {
+	stub := ctx.GetStub()
 	var jsonResp string
 	var itemJSON item
 
 	fmt.Println("- start delete item")
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if err := checkPeriodNow(stub, companyID); err != nil {
+		return err
 	}
-	companyID := args[0]
-	specID := args[1]
 
 	key := fmt.Sprintf("%s-%s", companyID, specID)
 	itemAsbytes, err := stub.GetState(key) //get the item from chaincode state
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return errors.New(jsonResp)
 	} else if itemAsbytes == nil {
 		jsonResp = "{\"Error\":\"Item does not exist: " + key + "\"}"
-		return shim.Error(jsonResp)
+		return errors.New(jsonResp)
 	}
 
-	err = json.Unmarshal([]byte(itemAsbytes), &itemJSON)
+	err = decodeItem(itemAsbytes, &itemJSON)
 	if err != nil {
 		jsonResp = "{\"Error\":\"Failed to decode JSON of: " + specID + "\"}"
-		return shim.Error(jsonResp)
+		return errors.New(jsonResp)
 	}
 
 	err = stub.DelState(key) //remove the item from chaincode state
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return errors.New("Failed to delete state:" + err.Error())
+	}
+	if err := deleteLots(stub, companyID, specID); err != nil {
+		return err
+	}
+	collection, err := costCollection(stub, companyID)
+	if err != nil {
+		return err
+	}
+	if err := stub.DelPrivateData(collection, key); err != nil {
+		return err
 	}
 
 	fmt.Println("- end delete item")
-	return shim.Success(nil)
+	return nil
 }
 
 // ==================================================
 // query - query a item by ID
 // ==================================================
-func (t *ItemChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *ItemChaincode) Query(ctx contractapi.TransactionContextInterface, companyID string, specID string) (*item, error) {
+	stub := ctx.GetStub()
 
 	fmt.Println("- start query item")
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-
-	companyID := args[0]
-	specID := args[1]
 
 	key := fmt.Sprintf("%s-%s", companyID, specID)
 	// Get the state from the ledger
 	itemAsbytes, err := stub.GetState(key)
 	if err != nil {
 		jsonResp := "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return shim.Error(jsonResp)
+		return nil, errors.New(jsonResp)
 	}
 
 	if itemAsbytes == nil {
 		jsonResp := "{\"Error\":\"Nil how3 for " + specID + "\"}"
-		return shim.Error(jsonResp)
+		return nil, errors.New(jsonResp)
 	}
 
-	jsonResp := "{\"How3\":\"" + string(itemAsbytes) + "\"}"
-	fmt.Printf("Query Response:%s\n", jsonResp)
+	// ==== Report stock per location as well as the total ====
+	var i item
+	err = decodeItem(itemAsbytes, &i)
+	if err != nil {
+		return nil, err
+	}
+	// only members of the owner's cost collection see the cost
+	if err := readCost(stub, &i); err != nil {
+		i.Cost = 0
+	}
+	i.normalizeLocations()
 
 	fmt.Println("- end query item")
-	return shim.Success(itemAsbytes)
+	return &i, nil
 }
 
-func (t *ItemChaincode) getHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+func (t *ItemChaincode) GetHistory(ctx contractapi.TransactionContextInterface, companyID string, specID string) ([]itemHistory, error) {
+	stub := ctx.GetStub()
 	fmt.Println("- start getHistory item")
 
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
-	}
-
-	companyID := args[0]
-	specID := args[1]
-
 	key := fmt.Sprintf("%s-%s", companyID, specID)
 
 	fmt.Printf("- start getHistory: %s\n", key)
 
 	resultsIterator, err := stub.GetHistoryForKey(key)
 	if err != nil {
-		return shim.Error(err.Error())
+		return nil, err
 	}
 	defer resultsIterator.Close()
 
-	// buffer is a JSON array containing historic values for the item
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	bArrayMemberAlreadyWritten := false
+	history := []itemHistory{}
 	for resultsIterator.HasNext() {
 		response, err := resultsIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return nil, err
 		}
-		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
-			buffer.WriteString(",")
+		h := itemHistory{
+			TxId:      response.TxId,
+			Timestamp: time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String(),
+			IsDelete:  response.IsDelete,
 		}
-		buffer.WriteString("{\"TxId\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(response.TxId)
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"Value\":")
-		// if it was a delete operation on given key, then we need to set the
-		//corresponding value null. Else, we will write the response.Value
-		//as-is (as the Value itself a JSON item)
-		if response.IsDelete {
-			buffer.WriteString("null")
-		} else {
-			buffer.WriteString(string(response.Value))
+		// a delete leaves Value out, older versions are read as the current
+		if !response.IsDelete {
+			h.Value = &item{}
+			if err := decodeItem(response.Value, h.Value); err != nil {
+				return nil, errors.New("Failed to decode JSON of: " + key)
+			}
 		}
-
-		buffer.WriteString(", \"Timestamp\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-		buffer.WriteString("\"")
-
-		buffer.WriteString(", \"IsDelete\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(strconv.FormatBool(response.IsDelete))
-		buffer.WriteString("\"")
-
-		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+		history = append(history, h)
 	}
-	buffer.WriteString("]")
-
-	fmt.Printf("- getHistoryForStore returning:\n%s\n", buffer.String())
 
 	fmt.Println("- end getHistory item")
-	return shim.Success(buffer.Bytes())
+	return history, nil
 }
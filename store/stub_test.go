@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+)
+
+// privateStub is a MockStub whose private data collections can also be
+// scanned and deleted from, which shimtest does not support. Each
+// collection is kept in a MockStub of its own.
+type privateStub struct {
+	*shimtest.MockStub
+	collections map[string]*shimtest.MockStub
+}
+
+func newPrivateStub() *privateStub {
+	stub := &privateStub{MockStub: shimtest.NewMockStub("store", nil), collections: map[string]*shimtest.MockStub{}}
+	stub.MockTransactionStart("tx1")
+	return stub
+}
+
+func (s *privateStub) collection(name string) *shimtest.MockStub {
+	c, ok := s.collections[name]
+	if !ok {
+		c = shimtest.NewMockStub(name, nil)
+		c.MockTransactionStart(s.TxID)
+		s.collections[name] = c
+	}
+	return c
+}
+
+func (s *privateStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	return s.collection(collection).GetState(key)
+}
+
+func (s *privateStub) PutPrivateData(collection string, key string, value []byte) error {
+	return s.collection(collection).PutState(key, value)
+}
+
+func (s *privateStub) DelPrivateData(collection string, key string) error {
+	return s.collection(collection).DelState(key)
+}
+
+func (s *privateStub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	return s.collection(collection).GetStateByPartialCompositeKey(objectType, attributes)
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Valuation methods a company can select with setValuation. Cost layers are
+// kept for every company so that switching method never loses history; the
+// method only decides how COGS is computed when stock is issued.
+const (
+	valuationAverage = "average"
+	valuationFIFO    = "fifo"
+)
+
+// subPurchase is one received line. Serials, when given, number the tyres
+// one by one.
+type subPurchase struct {
+	SpecID  int      `json:"spec_id"`
+	How     int      `json:"how"`
+	Money   float64  `json:"money"`
+	DotWeek string   `json:"dot_week,omitempty" metadata:",optional"`
+	Serials []string `json:"serials,omitempty" metadata:",optional"`
+}
+
+// purchase is what the purchase chaincode sends to receive and adjust.
+type purchase struct {
+	CompanyID string        `json:"company_id"`
+	OrderID   int           `json:"order_id"`
+	TabNo     string        `json:"tabno" metadata:",optional"`
+	Client    string        `json:"client"`
+	AccTime   int64         `json:"acc_time"`
+	Location  string        `json:"location,omitempty" metadata:",optional"`
+	Items     []subPurchase `json:"items"`
+}
+
+// subSelling is one sold line. DotWeek picks the lot to sell from instead of
+// the oldest.
+type subSelling struct {
+	SpecID  int      `json:"spec_id"`
+	How     int      `json:"how"`
+	Money   float64  `json:"money"`
+	DotWeek string   `json:"dot_week,omitempty" metadata:",optional"`
+	Serials []string `json:"serials,omitempty" metadata:",optional"`
+}
+
+// selling is what the sell chaincode sends to issue.
+type selling struct {
+	CompanyID string       `json:"company_id"`
+	OrderID   int          `json:"order_id"`
+	TabNo     string       `json:"tabno" metadata:",optional"`
+	Client    string       `json:"client"`
+	AccTime   int64        `json:"acc_time"`
+	Location  string       `json:"location,omitempty" metadata:",optional"`
+	Items     []subSelling `json:"items"`
+}
+
+// costLayer is the remaining quantity of one purchase line, valued at the
+// unit cost it was bought for. Layers are kept in the owner's cost
+// collection.
+type costLayer struct {
+	CompanyID string  `json:"company_id"`
+	SpecID    string  `json:"spec_id"`
+	OrderID   int     `json:"order_id"`
+	AccTime   int64   `json:"acc_time"`
+	How       int     `json:"how"`
+	UnitCost  float64 `json:"unit_cost"`
+}
+
+type lineCost struct {
+	SpecID int     `json:"spec_id"`
+	How    int     `json:"how"`
+	Money  float64 `json:"money"`
+	COGS   float64 `json:"cogs"`
+	Margin float64 `json:"margin"`
+}
+
+// saleCost is the costing result of one sale, kept in the owner's cost
+// collection for marginReport and returned to the sell chaincode by issue.
+type saleCost struct {
+	CompanyID string     `json:"company_id"`
+	OrderID   int        `json:"order_id"`
+	AccTime   int64      `json:"acc_time"`
+	Method    string     `json:"method"`
+	Items     []lineCost `json:"items"`
+	Revenue   float64    `json:"revenue"`
+	COGS      float64    `json:"cogs"`
+	Margin    float64    `json:"margin"`
+}
+
+type marginLine struct {
+	SpecID      int     `json:"spec_id"`
+	Description string  `json:"description"`
+	How         int     `json:"how"`
+	Revenue     float64 `json:"revenue"`
+	COGS        float64 `json:"cogs"`
+	Margin      float64 `json:"margin"`
+}
+
+// ============================================================
+// setValuation - select the valuation method of a company
+// ============================================================
+func (t *ItemChaincode) SetValuation(ctx contractapi.TransactionContextInterface, companyID string, method string) error {
+	stub := ctx.GetStub()
+	// ==== Input sanitation ====
+	fmt.Println("- start setValuation")
+	if len(companyID) <= 0 {
+		return errors.New("1st argument must be a non-empty string")
+	}
+	if method != valuationAverage && method != valuationFIFO {
+		return errors.New("2nd argument must be \"" + valuationAverage + "\" or \"" + valuationFIFO + "\"")
+	}
+
+	key, err := stub.CreateCompositeKey("valuation", []string{companyID})
+	if err != nil {
+		return err
+	}
+	err = putByOwner(stub, companyID, key, []byte(method))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("- end setValuation")
+	return nil
+}
+
+// getValuation returns the valuation method of a company: its own choice,
+// else the stock_policy of the configuration, else average cost.
+func getValuation(stub shim.ChaincodeStubInterface, companyID string) (string, error) {
+	key, err := stub.CreateCompositeKey("valuation", []string{companyID})
+	if err != nil {
+		return "", err
+	}
+	methodAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return "", err
+	}
+	if methodAsBytes == nil {
+		c, err := getConfig(stub)
+		if err != nil {
+			return "", err
+		}
+		if c.StockPolicy != nil && c.StockPolicy.Valuation != "" {
+			return c.StockPolicy.Valuation, nil
+		}
+		return valuationAverage, nil
+	}
+	return string(methodAsBytes), nil
+}
+
+// getItem reads the stock of a spec in a company. A missing key is returned
+// as an empty item so callers can add to it.
+func getItem(stub shim.ChaincodeStubInterface, companyID string, specID string) (*item, error) {
+	key := fmt.Sprintf("%s-%s", companyID, specID)
+	itemAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	i := &item{SchemaVersion: schemaVersion, CompanyID: companyID, SpecID: specID}
+	if itemAsBytes == nil {
+		i.isNew = true
+		return i, nil
+	}
+	if err := decodeItem(itemAsBytes, i); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON of: %s", key)
+	}
+	if err := readCost(stub, i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// putItem saves an item, its cost in the owner's collection and the rest in
+// public state, putting new stock under the endorsement of the company's
+// owner.
+func putItem(stub shim.ChaincodeStubInterface, i *item) error {
+	if err := writeCost(stub, i); err != nil {
+		return err
+	}
+	public := *i
+	public.Cost = 0
+	itemJSONasBytes, err := json.Marshal(public)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s-%s", i.CompanyID, i.SpecID)
+	if err := stub.PutState(key, itemJSONasBytes); err != nil {
+		return err
+	}
+	if i.isNew {
+		i.isNew = false
+		return endorseByOwner(stub, i.CompanyID, key)
+	}
+	return nil
+}
+
+// layerKey orders the layers of a spec by acc_time and then order_id, so a
+// partial composite key scan returns them oldest first.
+func layerKey(stub shim.ChaincodeStubInterface, l *costLayer) (string, error) {
+	return stub.CreateCompositeKey("layer", []string{
+		l.CompanyID,
+		l.SpecID,
+		fmt.Sprintf("%019d", l.AccTime),
+		strconv.Itoa(l.OrderID),
+	})
+}
+
+// ============================================================
+// receive - add the lines of a purchase to stock
+// ============================================================
+func (t *ItemChaincode) Receive(ctx contractapi.TransactionContextInterface, p purchase) error {
+	// lines may repeat a spec, lot or serial, read them back as written
+	stub := newTxStub(ctx.GetStub())
+	// ==== Input sanitation ====
+	fmt.Println("- start receive")
+	if p.CompanyID == "" {
+		return errors.New("company_id must be required")
+	}
+	if err := calledByChaincode(stub, "receive"); err != nil {
+		return err
+	}
+	if err := checkCompany(stub, p.CompanyID); err != nil {
+		return err
+	}
+	if err := checkPeriod(stub, p.CompanyID, p.AccTime); err != nil {
+		return err
+	}
+	collection, err := costCollection(stub, p.CompanyID)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range p.Items {
+		if line.How <= 0 {
+			return fmt.Errorf("how of spec_id %d must be positive", line.SpecID)
+		}
+		if err := checkSerialCount(line.SpecID, line.How, line.Serials); err != nil {
+			return err
+		}
+		if err := receiveSerials(stub, &p, &line); err != nil {
+			return err
+		}
+		if err := receiveLots(stub, p.CompanyID, &line); err != nil {
+			return err
+		}
+		specID := strconv.Itoa(line.SpecID)
+
+		i, err := getItem(stub, p.CompanyID, specID)
+		if err != nil {
+			return err
+		}
+		if err := i.addLocation(locationOrDefault(p.Location), line.How); err != nil {
+			return err
+		}
+		i.Cost += line.Money
+		if err := putItem(stub, i); err != nil {
+			return err
+		}
+
+		layer := &costLayer{
+			CompanyID: p.CompanyID,
+			SpecID:    specID,
+			OrderID:   p.OrderID,
+			AccTime:   p.AccTime,
+			How:       line.How,
+			UnitCost:  line.Money / float64(line.How),
+		}
+		key, err := layerKey(stub, layer)
+		if err != nil {
+			return err
+		}
+		// a purchase may list the same spec twice, merge it into one layer
+		layerAsBytes, err := stub.GetPrivateData(collection, key)
+		if err != nil {
+			return err
+		} else if layerAsBytes != nil {
+			var old costLayer
+			if err := json.Unmarshal(layerAsBytes, &old); err != nil {
+				return errors.New("Failed to decode JSON of: " + key)
+			}
+			total := old.UnitCost*float64(old.How) + line.Money
+			layer.How += old.How
+			layer.UnitCost = total / float64(layer.How)
+		}
+		layerJSONasBytes, err := json.Marshal(layer)
+		if err != nil {
+			return err
+		}
+		if err := putPrivateByOwner(stub, p.CompanyID, collection, key, layerJSONasBytes); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("- end receive")
+	return nil
+}
+
+// ============================================================
+// adjust - book the net change of an amended purchase. Each line carries the
+// change of the received quantity and of its cost, either may be negative.
+// The change is booked against the purchase's own layer, so it fails once
+// that stock has been issued.
+// ============================================================
+func (t *ItemChaincode) Adjust(ctx contractapi.TransactionContextInterface, p purchase) error {
+	stub := newTxStub(ctx.GetStub())
+	// ==== Input sanitation ====
+	fmt.Println("- start adjust")
+	if p.CompanyID == "" {
+		return errors.New("company_id must be required")
+	}
+	if err := calledByChaincode(stub, "adjust"); err != nil {
+		return err
+	}
+	if err := checkPeriod(stub, p.CompanyID, p.AccTime); err != nil {
+		return err
+	}
+	collection, err := costCollection(stub, p.CompanyID)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range p.Items {
+		if len(line.Serials) > 0 {
+			return fmt.Errorf("serials of spec_id %d can not be adjusted", line.SpecID)
+		}
+		specID := strconv.Itoa(line.SpecID)
+		if line.How != 0 {
+			week, err := lotWeek(line.DotWeek)
+			if err != nil {
+				return err
+			}
+			if err := addLot(stub, p.CompanyID, specID, week, line.How); err != nil {
+				return err
+			}
+		}
+
+		layer := &costLayer{
+			CompanyID: p.CompanyID,
+			SpecID:    specID,
+			OrderID:   p.OrderID,
+			AccTime:   p.AccTime,
+		}
+		key, err := layerKey(stub, layer)
+		if err != nil {
+			return err
+		}
+		layerAsBytes, err := stub.GetPrivateData(collection, key)
+		if err != nil {
+			return err
+		}
+		var total float64
+		if layerAsBytes != nil {
+			if err := json.Unmarshal(layerAsBytes, layer); err != nil {
+				return errors.New("Failed to decode JSON of: " + key)
+			}
+			total = layer.UnitCost * float64(layer.How)
+		}
+		total += line.Money
+		layer.How += line.How
+		if layer.How < 0 || (layer.How == 0 && math.Abs(total) >= 0.005) {
+			return fmt.Errorf("spec_id %d of %s-%d has already been issued", line.SpecID, p.CompanyID, p.OrderID)
+		}
+		if layer.How == 0 {
+			err = stub.DelPrivateData(collection, key)
+		} else {
+			layer.UnitCost = total / float64(layer.How)
+			var layerJSONasBytes []byte
+			layerJSONasBytes, err = json.Marshal(layer)
+			if err == nil {
+				err = putPrivateByOwner(stub, p.CompanyID, collection, key, layerJSONasBytes)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		i, err := getItem(stub, p.CompanyID, specID)
+		if err != nil {
+			return err
+		}
+		if err := i.addLocation(locationOrDefault(p.Location), line.How); err != nil {
+			return err
+		}
+		i.Cost = round2(i.Cost + line.Money)
+		if i.How3 == 0 {
+			i.Cost = 0
+		}
+		if err := putItem(stub, i); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("- end adjust")
+	return nil
+}
+
+// ============================================================
+// issue - take the lines of a sale out of stock and cost them
+// ============================================================
+func (t *ItemChaincode) Issue(ctx contractapi.TransactionContextInterface, s selling) (*saleCost, error) {
+	stub := newTxStub(ctx.GetStub())
+	// ==== Input sanitation ====
+	fmt.Println("- start issue")
+	if s.CompanyID == "" {
+		return nil, errors.New("company_id must be required")
+	}
+	if err := calledByChaincode(stub, "issue"); err != nil {
+		return nil, err
+	}
+	if err := checkCompany(stub, s.CompanyID); err != nil {
+		return nil, err
+	}
+	if err := checkPeriod(stub, s.CompanyID, s.AccTime); err != nil {
+		return nil, err
+	}
+	collection, err := costCollection(stub, s.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	costKey, err := stub.CreateCompositeKey("cogs", []string{s.CompanyID, strconv.Itoa(s.OrderID)})
+	if err != nil {
+		return nil, err
+	}
+	costAsBytes, err := stub.GetPrivateData(collection, costKey)
+	if err != nil {
+		return nil, err
+	} else if costAsBytes != nil {
+		return nil, fmt.Errorf("The sale %s-%d has already been issued!", s.CompanyID, s.OrderID)
+	}
+
+	method, err := getValuation(stub, s.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := saleCost{
+		CompanyID: s.CompanyID,
+		OrderID:   s.OrderID,
+		AccTime:   s.AccTime,
+		Method:    method,
+		Items:     []lineCost{},
+	}
+	for _, line := range s.Items {
+		if line.How <= 0 {
+			return nil, fmt.Errorf("how of spec_id %d must be positive", line.SpecID)
+		}
+		if err := checkSerialCount(line.SpecID, line.How, line.Serials); err != nil {
+			return nil, err
+		}
+		if err := issueSerials(stub, &s, &line); err != nil {
+			return nil, err
+		}
+		taken, err := issueLots(stub, s.CompanyID, &line)
+		if err != nil {
+			return nil, err
+		}
+		if err := recordLotSales(stub, &s, taken); err != nil {
+			return nil, err
+		}
+		specID := strconv.Itoa(line.SpecID)
+
+		i, err := getItem(stub, s.CompanyID, specID)
+		if err != nil {
+			return nil, err
+		}
+		if i.How3 < line.How {
+			return nil, fmt.Errorf("Insufficient stock of %s-%s: %d on hand, %d requested", s.CompanyID, specID, i.How3, line.How)
+		}
+
+		fifoCost, err := consumeLayers(stub, collection, i, line.How)
+		if err != nil {
+			return nil, err
+		}
+		cogs := fifoCost
+		if method == valuationAverage {
+			cogs = i.Cost / float64(i.How3) * float64(line.How)
+		}
+		cogs = round2(cogs)
+
+		if err := i.addLocation(locationOrDefault(s.Location), -line.How); err != nil {
+			return nil, err
+		}
+		i.Cost = round2(i.Cost - cogs)
+		if i.How3 == 0 {
+			i.Cost = 0
+		}
+		if err := putItem(stub, i); err != nil {
+			return nil, err
+		}
+
+		sc.Items = append(sc.Items, lineCost{
+			SpecID: line.SpecID,
+			How:    line.How,
+			Money:  line.Money,
+			COGS:   cogs,
+			Margin: round2(line.Money - cogs),
+		})
+		sc.Revenue += line.Money
+		sc.COGS += cogs
+	}
+	sc.Revenue = round2(sc.Revenue)
+	sc.COGS = round2(sc.COGS)
+	sc.Margin = round2(sc.Revenue - sc.COGS)
+
+	costJSONasBytes, err := json.Marshal(sc)
+	if err != nil {
+		return nil, err
+	}
+	err = putPrivateByOwner(stub, s.CompanyID, collection, costKey, costJSONasBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("- end issue")
+	return &sc, nil
+}
+
+// consumeLayers takes how units off the oldest layers of an item and returns
+// their cost. Stock that was booked without a purchase (create/update) has
+// no layers and is costed at the item's average cost. The peer does not
+// re-check private range scans at commit; the item key, which every change
+// of the layers also writes, serializes the transactions instead.
+func consumeLayers(stub shim.ChaincodeStubInterface, collection string, i *item, how int) (float64, error) {
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey(collection, "layer", []string{i.CompanyID, i.SpecID})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+
+	var cost float64
+	remaining := how
+	for remaining > 0 && resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		var layer costLayer
+		if err := json.Unmarshal(response.Value, &layer); err != nil {
+			return 0, fmt.Errorf("Failed to decode JSON of: %s", response.Key)
+		}
+
+		take := layer.How
+		if take > remaining {
+			take = remaining
+		}
+		cost += layer.UnitCost * float64(take)
+		remaining -= take
+		layer.How -= take
+
+		if layer.How == 0 {
+			err = stub.DelPrivateData(collection, response.Key)
+		} else {
+			var layerJSONasBytes []byte
+			layerJSONasBytes, err = json.Marshal(layer)
+			if err == nil {
+				err = putPrivateByOwner(stub, i.CompanyID, collection, response.Key, layerJSONasBytes)
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if remaining > 0 && i.How3 > 0 {
+		cost += i.Cost / float64(i.How3) * float64(remaining)
+	}
+	return cost, nil
+}
+
+// ==================================================
+// marginReport - revenue, COGS and margin by spec_id
+// ==================================================
+func (t *ItemChaincode) MarginReport(ctx contractapi.TransactionContextInterface, companyID string, from int64, to int64) ([]marginLine, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start marginReport")
+	// ==== Input sanitation ====
+	if len(companyID) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+
+	collection, err := costCollection(stub, companyID)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey(collection, "cogs", []string{companyID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	lines := map[int]*marginLine{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var sc saleCost
+		if err := json.Unmarshal(response.Value, &sc); err != nil {
+			return nil, errors.New("Failed to decode JSON of: " + response.Key)
+		}
+		if sc.AccTime < from || sc.AccTime > to {
+			continue
+		}
+		for _, lc := range sc.Items {
+			ml, ok := lines[lc.SpecID]
+			if !ok {
+				ml = &marginLine{SpecID: lc.SpecID}
+				lines[lc.SpecID] = ml
+			}
+			ml.How += lc.How
+			ml.Revenue += lc.Money
+			ml.COGS += lc.COGS
+		}
+	}
+
+	// ==== Describe the specs for the reader ====
+	specIDs := []string{}
+	for specID := range lines {
+		specIDs = append(specIDs, strconv.Itoa(specID))
+	}
+	specIDsAsBytes, err := json.Marshal(specIDs)
+	if err != nil {
+		return nil, err
+	}
+	describeArgs := [][]byte{[]byte("describe"), specIDsAsBytes}
+	descriptions := map[string]string{}
+	response := stub.InvokeChaincode(specChaincode, describeArgs, "")
+	if response.Status != shim.OK {
+		return nil, errors.New("Failed to describe specs: " + response.Message)
+	}
+	if err := json.Unmarshal(response.Payload, &descriptions); err != nil {
+		return nil, errors.New("Invalid descriptions returned by spec")
+	}
+
+	report := make([]marginLine, 0, len(lines))
+	for _, ml := range lines {
+		ml.Description = descriptions[strconv.Itoa(ml.SpecID)]
+		ml.Revenue = round2(ml.Revenue)
+		ml.COGS = round2(ml.COGS)
+		ml.Margin = round2(ml.Revenue - ml.COGS)
+		report = append(report, *ml)
+	}
+	sort.Slice(report, func(a, b int) bool { return report[a].SpecID < report[b].SpecID })
+
+	fmt.Println("- end marginReport")
+	return report, nil
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
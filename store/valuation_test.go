@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestConsumeLayers(t *testing.T) {
+	const collection = "Org1MSPCosts"
+	tests := []struct {
+		name   string
+		layers []costLayer
+		item   item
+		how    int
+		cost   float64
+		left   []int
+	}{
+		{
+			name:   "part of one layer",
+			layers: []costLayer{{OrderID: 1, AccTime: 100, How: 10, UnitCost: 5}},
+			item:   item{How3: 10, Cost: 50},
+			how:    4,
+			cost:   20,
+			left:   []int{6},
+		},
+		{
+			name: "oldest layer first",
+			layers: []costLayer{
+				{OrderID: 2, AccTime: 200, How: 5, UnitCost: 7},
+				{OrderID: 1, AccTime: 100, How: 3, UnitCost: 5},
+			},
+			item: item{How3: 8, Cost: 50},
+			how:  4,
+			cost: 3*5 + 1*7,
+			left: []int{4},
+		},
+		{
+			name:   "whole layer",
+			layers: []costLayer{{OrderID: 1, AccTime: 100, How: 2, UnitCost: 5}},
+			item:   item{How3: 2, Cost: 10},
+			how:    2,
+			cost:   10,
+			left:   []int{},
+		},
+		{
+			name:   "past the layers at average cost",
+			layers: []costLayer{{OrderID: 1, AccTime: 100, How: 2, UnitCost: 5}},
+			item:   item{How3: 10, Cost: 80},
+			how:    5,
+			cost:   2*5 + 3*8,
+			left:   []int{},
+		},
+		{
+			name: "no layers at average cost",
+			item: item{How3: 4, Cost: 40},
+			how:  1,
+			cost: 10,
+			left: []int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newPrivateStub()
+			if err := putOwner(stub, &owner{CompanyID: "3", MSPID: "Org1MSP"}); err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range tt.layers {
+				l.CompanyID, l.SpecID = "3", "1111"
+				key, err := layerKey(stub, &l)
+				if err != nil {
+					t.Fatal(err)
+				}
+				layerJSONasBytes, _ := json.Marshal(l)
+				if err := stub.PutPrivateData(collection, key, layerJSONasBytes); err != nil {
+					t.Fatal(err)
+				}
+			}
+			i := tt.item
+			i.CompanyID, i.SpecID = "3", "1111"
+
+			cost, err := consumeLayers(stub, collection, &i, tt.how)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if round2(cost) != round2(tt.cost) {
+				t.Errorf("cost = %v, want %v", cost, tt.cost)
+			}
+
+			left := []int{}
+			resultsIterator, _ := stub.GetPrivateDataByPartialCompositeKey(collection, "layer", []string{"3", "1111"})
+			for resultsIterator.HasNext() {
+				response, _ := resultsIterator.Next()
+				var l costLayer
+				if err := json.Unmarshal(response.Value, &l); err != nil {
+					t.Fatal(err)
+				}
+				left = append(left, l.How)
+			}
+			if !reflect.DeepEqual(left, tt.left) {
+				t.Errorf("layers left = %v, want %v", left, tt.left)
+			}
+		})
+	}
+}
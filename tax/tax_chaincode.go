@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Names of the order chaincodes, installed on the same channel. Each keeps
+// the tax entries of its own documents; taxReport combines them.
+const (
+	purchaseChaincode = "purchase"
+	sellChaincode     = "sell"
+)
+
+// Only callers whose certificate carries role=manager or role=finance may
+// add or replace a tax code.
+const (
+	roleAttribute = "role"
+	managerRole   = "manager"
+	financeRole   = "finance"
+)
+
+type TaxChaincode struct {
+	contractapi.Contract
+}
+
+// taxCode is one version of a tax code, in effect from effective_from to
+// effective_to (YYYYMMDD, inclusive; open-ended when empty). Rate is a
+// percentage.
+type taxCode struct {
+	Code          string  `json:"code"`
+	Rate          float64 `json:"rate"`
+	Type          string  `json:"type"`
+	EffectiveFrom string  `json:"effective_from"`
+	EffectiveTo   string  `json:"effective_to" metadata:",optional"`
+	Description   string  `json:"description" metadata:",optional"`
+}
+
+var taxTypes = map[string]bool{
+	"standard": true,
+	"reduced":  true,
+	"zero":     true,
+	"exempt":   true,
+}
+
+// taxLine and taxEntry are what the order chaincodes return from
+// taxEntries: the tax of one document, by line.
+type taxLine struct {
+	TaxCode string  `json:"tax_code"`
+	Rate    float64 `json:"rate"`
+	Base    float64 `json:"base"`
+	Tax     float64 `json:"tax"`
+}
+
+type taxEntry struct {
+	CompanyID string    `json:"company_id"`
+	DocType   string    `json:"doc_type"`
+	DocID     string    `json:"doc_id"`
+	AccTime   int64     `json:"acc_time"`
+	Lines     []taxLine `json:"lines"`
+}
+
+type reportLine struct {
+	Direction string  `json:"direction"`
+	TaxCode   string  `json:"tax_code"`
+	Rate      float64 `json:"rate"`
+	Base      float64 `json:"base"`
+	Tax       float64 `json:"tax"`
+}
+
+type taxReport struct {
+	CompanyID string       `json:"company_id"`
+	Period    string       `json:"period"`
+	Lines     []reportLine `json:"lines"`
+	InputTax  float64      `json:"input_tax"`
+	OutputTax float64      `json:"output_tax"`
+	Payable   float64      `json:"payable"`
+}
+
+// ===================================================================================
+// Main
+// ===================================================================================
+func main() {
+	chaincode, err := contractapi.NewChaincode(newTaxChaincode())
+	if err != nil {
+		fmt.Printf("Error creating tax chaincode: %s", err)
+		return
+	}
+	if err := chaincode.Start(); err != nil {
+		fmt.Printf("Error starting tax chaincode: %s", err)
+	}
+}
+
+func newTaxChaincode() *TaxChaincode {
+	t := new(TaxChaincode)
+	t.Name = "tax"
+	t.Info.Description = "Tax codes and the tax report of purchases and sales"
+	return t
+}
+
+// GetEvaluateTransactions marks the transactions that only read the ledger,
+// so clients query rather than submit them.
+func (t *TaxChaincode) GetEvaluateTransactions() []string {
+	return []string{"QueryTaxCode", "Resolve", "TaxReport"}
+}
+
+// ============================================================
+// setTaxCode - add or replace a version of a tax code
+// ============================================================
+func (t *TaxChaincode) SetTaxCode(ctx contractapi.TransactionContextInterface, tc taxCode) error {
+	stub := ctx.GetStub()
+
+	// ==== Input sanitation ====
+	fmt.Println("- start setTaxCode")
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue(roleAttribute)
+	if err != nil {
+		return err
+	}
+	if !found || (role != managerRole && role != financeRole) {
+		return errors.New("Only a " + managerRole + " or " + financeRole + " may set a tax code")
+	}
+	if tc.Code == "" {
+		return errors.New("code must be required")
+	}
+	if tc.Rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	if !taxTypes[tc.Type] {
+		return errors.New("type must be standard, reduced, zero or exempt")
+	}
+	if _, err := time.Parse("20060102", tc.EffectiveFrom); err != nil {
+		return errors.New("effective_from must be a date YYYYMMDD")
+	}
+	if tc.EffectiveTo != "" {
+		if _, err := time.Parse("20060102", tc.EffectiveTo); err != nil {
+			return errors.New("effective_to must be a date YYYYMMDD")
+		}
+		if tc.EffectiveTo < tc.EffectiveFrom {
+			return errors.New("effective_to must not be before effective_from")
+		}
+	}
+
+	key, err := stub.CreateCompositeKey("taxcode", []string{tc.Code, tc.EffectiveFrom})
+	if err != nil {
+		return err
+	}
+	codeJSONasBytes, err := json.Marshal(tc)
+	if err != nil {
+		return err
+	}
+	if err := stub.PutState(key, codeJSONasBytes); err != nil {
+		return err
+	}
+
+	fmt.Println("- end setTaxCode")
+	return nil
+}
+
+// ==================================================
+// queryTaxCode - all versions of a tax code
+// ==================================================
+func (t *TaxChaincode) QueryTaxCode(ctx contractapi.TransactionContextInterface, code string) ([]taxCode, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start queryTaxCode")
+
+	versions, err := codeVersions(stub, code)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		jsonResp := "{\"Error\":\"Nil tax code for " + code + "\"}"
+		return nil, errors.New(jsonResp)
+	}
+
+	fmt.Println("- end queryTaxCode")
+	return versions, nil
+}
+
+func codeVersions(stub shim.ChaincodeStubInterface, code string) ([]taxCode, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey("taxcode", []string{code})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	versions := []taxCode{}
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var tc taxCode
+		if err := json.Unmarshal(response.Value, &tc); err != nil {
+			return nil, fmt.Errorf("Failed to decode JSON of: %s", response.Key)
+		}
+		versions = append(versions, tc)
+	}
+	return versions, nil
+}
+
+// ==================================================
+// resolve - rates of tax codes in effect on a day
+// ==================================================
+// args: date YYYYMMDD, codes. Returns a map of code to rate and fails for a
+// code not in effect on that day.
+func (t *TaxChaincode) Resolve(ctx contractapi.TransactionContextInterface, date string, codes []string) (map[string]float64, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start resolve")
+
+	rates := map[string]float64{}
+	for _, code := range codes {
+		versions, err := codeVersions(stub, code)
+		if err != nil {
+			return nil, err
+		}
+		var found *taxCode
+		for i := range versions {
+			v := &versions[i]
+			if v.EffectiveFrom <= date && (v.EffectiveTo == "" || date <= v.EffectiveTo) {
+				found = v
+			}
+		}
+		if found == nil {
+			return nil, errors.New("Tax code " + code + " is not in effect on " + date)
+		}
+		rates[code] = found.Rate
+	}
+
+	fmt.Println("- end resolve")
+	return rates, nil
+}
+
+// periodRange turns a period "YYYYMM" or "YYYYQn" into unix times
+// [from, to), in UTC.
+func periodRange(period string) (int64, int64, error) {
+	if len(period) == 6 && period[4] == 'Q' {
+		year, err := strconv.Atoi(period[:4])
+		quarter := int(period[5] - '0')
+		if err != nil || quarter < 1 || quarter > 4 {
+			return 0, 0, fmt.Errorf("period %s must be YYYYMM or YYYYQn", period)
+		}
+		from := time.Date(year, time.Month(quarter*3-2), 1, 0, 0, 0, 0, time.UTC)
+		return from.Unix(), from.AddDate(0, 3, 0).Unix(), nil
+	}
+	from, err := time.Parse("200601", period)
+	if err != nil {
+		return 0, 0, fmt.Errorf("period %s must be YYYYMM or YYYYQn", period)
+	}
+	return from.Unix(), from.AddDate(0, 1, 0).Unix(), nil
+}
+
+// ==================================================
+// taxReport - taxable base and tax by code for a company and period
+// ==================================================
+func (t *TaxChaincode) TaxReport(ctx contractapi.TransactionContextInterface, companyID string, period string) (*taxReport, error) {
+	stub := ctx.GetStub()
+	fmt.Println("- start taxReport")
+
+	// ==== Input sanitation ====
+	if len(companyID) <= 0 {
+		return nil, errors.New("1st argument must be a non-empty string")
+	}
+	from, to, err := periodRange(period)
+	if err != nil {
+		return nil, err
+	}
+
+	report := taxReport{CompanyID: companyID, Period: period, Lines: []reportLine{}}
+	lines := map[string]*reportLine{}
+	for _, source := range []struct {
+		chaincode string
+		direction string
+	}{
+		{purchaseChaincode, "input"},
+		{sellChaincode, "output"},
+	} {
+		queryArgs := [][]byte{[]byte("taxEntries"), []byte(companyID), []byte(strconv.FormatInt(from, 10)), []byte(strconv.FormatInt(to, 10))}
+		response := stub.InvokeChaincode(source.chaincode, queryArgs, "")
+		if response.Status != shim.OK {
+			return nil, errors.New("Failed to get tax entries from " + source.chaincode + ": " + response.Message)
+		}
+		var entries []taxEntry
+		if err := json.Unmarshal(response.Payload, &entries); err != nil {
+			return nil, errors.New("Invalid tax entries returned by " + source.chaincode)
+		}
+
+		for _, e := range entries {
+			for _, tl := range e.Lines {
+				// the same code may have changed rate within the period
+				lineKey := strings.Join([]string{source.direction, tl.TaxCode, strconv.FormatFloat(tl.Rate, 'f', -1, 64)}, "|")
+				rl, ok := lines[lineKey]
+				if !ok {
+					rl = &reportLine{Direction: source.direction, TaxCode: tl.TaxCode, Rate: tl.Rate}
+					lines[lineKey] = rl
+				}
+				rl.Base += tl.Base
+				rl.Tax += tl.Tax
+				if source.direction == "input" {
+					report.InputTax += tl.Tax
+				} else {
+					report.OutputTax += tl.Tax
+				}
+			}
+		}
+	}
+
+	for _, rl := range lines {
+		rl.Base = round2(rl.Base)
+		rl.Tax = round2(rl.Tax)
+		report.Lines = append(report.Lines, *rl)
+	}
+	sort.Slice(report.Lines, func(a, b int) bool {
+		la, lb := report.Lines[a], report.Lines[b]
+		if la.Direction != lb.Direction {
+			return la.Direction < lb.Direction
+		}
+		if la.TaxCode != lb.TaxCode {
+			return la.TaxCode < lb.TaxCode
+		}
+		return la.Rate < lb.Rate
+	})
+	report.InputTax = round2(report.InputTax)
+	report.OutputTax = round2(report.OutputTax)
+	report.Payable = round2(report.OutputTax - report.InputTax)
+
+	fmt.Println("- end taxReport")
+	return &report, nil
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}